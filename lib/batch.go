@@ -0,0 +1,104 @@
+package lib
+
+// WriteBatch collects puts and deletes to be applied to a BTree atomically
+// with Write. A batch is not safe for concurrent use.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// batchOp is a single put or delete in a WriteBatch.
+type batchOp struct {
+	delete bool
+	key    string
+	value  []byte
+}
+
+// NewWriteBatch returns an empty batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds an insert of key with value to the batch.
+func (wb *WriteBatch) Put(key string, value []byte) {
+	wb.ops = append(wb.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds a delete of key to the batch.
+func (wb *WriteBatch) Delete(key string) {
+	wb.ops = append(wb.ops, batchOp{delete: true, key: key})
+}
+
+// Len returns the number of operations in the batch.
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (wb *WriteBatch) Reset() {
+	wb.ops = wb.ops[:0]
+}
+
+// Write applies every operation of the batch in order, under a single
+// acquisition of the tree lock, and logs them as one record, so that recovery
+// replays either the whole batch or none of it. Puts behave like Insert.
+// Deleting a key that is not in the tree is not an error. Write returns once
+// the log record is durable.
+func (b *BTree) Write(batch *WriteBatch) error {
+	lsn, err := b.applyBatch(batch)
+	if err != nil {
+		return err
+	}
+	return b.waitDurable(lsn)
+}
+
+// applyBatch applies a batch under the tree lock and returns the LSN of its log record.
+func (b *BTree) applyBatch(batch *WriteBatch) (uint64, error) {
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return 0, b.failed
+	}
+
+	// Encrypt everything first so the tree is only touched once nothing can
+	// fail short of an I/O error
+	kvs := make([]*KeyValue, len(batch.ops))
+	entry := LogEntry{Operation: "BATCH", Ops: make([]LogEntry, len(batch.ops))}
+	for i, op := range batch.ops {
+		if op.delete {
+			entry.Ops[i] = LogEntry{Operation: "DELETE", Key: op.key}
+			continue
+		}
+		kv, err := b.newKeyValue(op.key, op.value)
+		if err != nil {
+			return 0, err
+		}
+		kv.Version = b.nextVersion()
+		kvs[i] = kv
+	}
+
+	for i, op := range batch.ops {
+		if op.delete {
+			found, err := b.removeKey(b.indexKey(op.key))
+			if err == nil && !found {
+				_, err = b.removePrevious(op.key)
+			}
+			if err != nil {
+				return 0, b.abort(err)
+			}
+			continue
+		}
+		item, at := b.find(op.key)
+		operation, err := b.storeEntry(op.key, item, at, kvs[i], false)
+		if err != nil {
+			return 0, err
+		}
+		entry.Ops[i] = putEntry(operation, op.key, kvs[i])
+	}
+
+	return b.commitOp(entry)
+}
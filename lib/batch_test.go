@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteBatchRecovery checks that a crash leaves either every operation of
+// a batch in the tree or none of them, also when its log record is torn.
+func TestWriteBatchRecovery(t *testing.T) {
+	const keys = 20
+	dir := t.TempDir()
+	b := openTestTree(t, dir, 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	model := make(map[string][]byte)
+	for i := 0; i < keys; i += 2 {
+		key := fmt.Sprintf("key-%04d", i)
+		model[key] = []byte("before")
+		if err := b.Insert(key, model[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch updates, creates and deletes keys
+	batch := NewWriteBatch()
+	first := make(map[string][]byte)
+	for key, value := range model {
+		first[key] = value
+	}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		if i%4 == 0 {
+			batch.Delete(key)
+			delete(first, key)
+			continue
+		}
+		first[key] = []byte("first")
+		batch.Put(key, first[key])
+	}
+	if err := b.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filepath.Join(dir, "kayvee.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSize := stat.Size()
+
+	// The second batch overwrites every key, and deletes a key created by the first
+	batch.Reset()
+	second := make(map[string][]byte)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		second[key] = []byte("second")
+		batch.Put(key, second[key])
+	}
+	batch.Delete("key-0001")
+	delete(second, "key-0001")
+	if err := b.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	checkModel(t, b, second, keys)
+
+	crash := copyDatabase(t, dir)
+	logPath := filepath.Join(crash, "kayvee.log")
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		log   []byte
+		model map[string][]byte
+	}{
+		{"complete", data, second},
+		{"second missing", data[:logSize], first},
+		{"second torn", data[:len(data)-5], first},
+		{"second corrupt", corruptByte(data, len(data)-5), first},
+		{"first torn", data[:logSize-5], model},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dst := copyDatabase(t, crash)
+			if err := os.WriteFile(filepath.Join(dst, "kayvee.log"), test.log, 0644); err != nil {
+				t.Fatal(err)
+			}
+			recovered := openTestTree(t, dst, 10, KeyModeHMAC)
+			defer closeTestTree(t, recovered)
+			checkModel(t, recovered, test.model, keys)
+		})
+	}
+}
+
+// corruptByte returns a copy of data with the byte at offset flipped.
+func corruptByte(data []byte, offset int) []byte {
+	corrupt := append([]byte(nil), data...)
+	corrupt[offset] ^= 0xff
+	return corrupt
+}
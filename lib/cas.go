@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every write of a key stores the LSN of its log record as the version of the
+// key, so versions only grow, also across a delete and a new insert of the
+// same key, and replay restores them exactly. Moving or re-encrypting a key
+// during a rotation keeps its version.
+
+// ErrVersionConflict is returned by CompareAndSwap when the key is not at the
+// expected version.
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrKeyExists is returned by InsertIfAbsent when the key is already present.
+var ErrKeyExists = errors.New("key already exists")
+
+// ConflictError reports a conditional write that was not applied because the
+// key was not in the expected state. It wraps ErrVersionConflict or
+// ErrKeyExists.
+type ConflictError struct {
+	Err      error  // ErrVersionConflict or ErrKeyExists
+	Key      string // Key of the write
+	Expected uint64 // Version the write expected
+	Actual   uint64 // Current version of the key, zero if it is not present
+	Exists   bool   // Whether the key is present
+}
+
+func (e *ConflictError) Error() string {
+	switch {
+	case e.Err == ErrKeyExists:
+		return fmt.Sprintf("%v: %s is at version %d", e.Err, e.Key, e.Actual)
+	case !e.Exists:
+		return fmt.Sprintf("%v: %s is not present, expected version %d", e.Err, e.Key, e.Expected)
+	}
+	return fmt.Sprintf("%v: %s is at version %d, expected %d", e.Err, e.Key, e.Actual, e.Expected)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// nextVersion returns the version of the keys written by the operation being
+// applied, the LSN its log record is going to get.
+func (b *BTree) nextVersion() uint64 {
+	return b.lsn + 1
+}
+
+// ReadWithVersion reads a value like Read and also returns the version of the
+// key, to pass to CompareAndSwap.
+func (b *BTree) ReadWithVersion(key string) ([]byte, uint64, error) {
+	b.mu.RLock()
+	if b.failed != nil {
+		b.mu.RUnlock()
+		return nil, 0, b.failed
+	}
+	item, hKey := b.find(key)
+	if item == nil || item.expired(time.Now()) {
+		b.mu.RUnlock()
+		return nil, 0, errors.New("key not found")
+	}
+	version := item.Version
+	value, err := b.decrypt(item.Value, b.valueKeys(), hKey)
+	b.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, version, nil
+}
+
+// CompareAndSwap replaces the value of a key like Update, but only if the key
+// is at expectedVersion. Otherwise, or if the key is not present, it returns a
+// *ConflictError wrapping ErrVersionConflict. It returns the new version of
+// the key once the log record is durable.
+func (b *BTree) CompareAndSwap(key string, expectedVersion uint64, newValue []byte) (uint64, error) {
+	check := func(item *KeyValue) error {
+		if item == nil {
+			return &ConflictError{Err: ErrVersionConflict, Key: key, Expected: expectedVersion}
+		}
+		if item.Version != expectedVersion {
+			return &ConflictError{Err: ErrVersionConflict, Key: key, Expected: expectedVersion, Actual: item.Version, Exists: true}
+		}
+		return nil
+	}
+	lsn, err := b.applyPut(key, newValue, putRequest{mode: PutUpdateOnly, check: check})
+	if err != nil {
+		return 0, err
+	}
+	if err := b.waitDurable(lsn); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// InsertIfAbsent inserts a key-value pair like Insert, but only if the key is
+// not present; an expired key counts as absent. Otherwise it returns a
+// *ConflictError wrapping ErrKeyExists with the version of the key. It returns
+// the version of the new key once the log record is durable.
+func (b *BTree) InsertIfAbsent(key string, value []byte) (uint64, error) {
+	lsn, err := b.applyPut(key, value, putRequest{mode: PutInsertOnly})
+	if err != nil {
+		return 0, err
+	}
+	if err := b.waitDurable(lsn); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestConditionalWrites checks the conflicts of CompareAndSwap and
+// InsertIfAbsent, and that versions only grow and survive replay.
+func TestConditionalWrites(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestTree(t, dir, 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	created, err := b.InsertIfAbsent("key", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.InsertIfAbsent("key", []byte("second"))
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrKeyExists) || !conflict.Exists || conflict.Actual != created {
+		t.Fatalf("second insert returned %v, expected a conflict at version %d", err, created)
+	}
+
+	_, err = b.CompareAndSwap("key", created+100, []byte("stale"))
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrVersionConflict) || conflict.Actual != created || conflict.Expected != created+100 {
+		t.Fatalf("swap at a stale version returned %v", err)
+	}
+	_, err = b.CompareAndSwap("missing", created, []byte("value"))
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrVersionConflict) || conflict.Exists {
+		t.Fatalf("swap of a missing key returned %v", err)
+	}
+	if value, err := b.Read("key"); err != nil || string(value) != "first" {
+		t.Fatalf("conflicting writes changed the value to %q, %v", value, err)
+	}
+
+	swapped, err := b.CompareAndSwap("key", created, []byte("swapped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped <= created {
+		t.Fatalf("swap moved the version from %d to %d", created, swapped)
+	}
+	if err := b.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	recreated, err := b.InsertIfAbsent("key", []byte("recreated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recreated <= swapped {
+		t.Fatalf("a new insert after a delete went from version %d to %d", swapped, recreated)
+	}
+
+	crashed := openTestTree(t, copyDatabase(t, dir), 10, KeyModeHMAC)
+	defer closeTestTree(t, crashed)
+	if value, version, err := crashed.ReadWithVersion("key"); err != nil || version != recreated || string(value) != "recreated" {
+		t.Fatalf("replayed key is %q at version %d, %v, expected version %d", value, version, err, recreated)
+	}
+}
+
+// TestConcurrentCompareAndSwap checks that concurrent read-modify-write loops
+// built on CompareAndSwap lose no update.
+func TestConcurrentCompareAndSwap(t *testing.T) {
+	const (
+		writers    = 8
+		increments = 50
+	)
+	b := openTestTree(t, t.TempDir(), 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	if _, err := b.InsertIfAbsent("count", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				value, version, err := b.ReadWithVersion("count")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count, _ := strconv.Atoi(string(value))
+				_, err = b.CompareAndSwap("count", version, []byte(fmt.Sprint(count+1)))
+				if errors.Is(err, ErrVersionConflict) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := b.Read("count"); err != nil || string(value) != fmt.Sprint(writers*increments) {
+		t.Fatalf("count is %q, %v, expected %d", value, err, writers*increments)
+	}
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Writes are made durable by the operation log alone. The tree itself is only
+// committed by a checkpoint, which flushes every changed node, records the LSN
+// of the last logged operation in the superblock and then truncates the log
+// to its header.
+// Recovery loads the last committed tree and replays the records after its
+// LSN. A crash between the commit and the truncation is harmless, because the
+// records left in the log are at or before the recorded LSN and are skipped.
+
+// DefaultCheckpointLogSize is the log size that triggers a checkpoint when
+// Options.CheckpointLogSize is not set.
+const DefaultCheckpointLogSize = 4 << 20
+
+// ErrNeedsRecovery is returned once an operation failed after other
+// operations were logged since the last checkpoint. The in-memory tree no
+// longer matches the log, and reopening the database replays it.
+var ErrNeedsRecovery = errors.New("tree must be reopened to recover from the log")
+
+// Checkpoint commits the tree and truncates the log, so that recovery only has
+// to replay the operations logged after it.
+func (b *BTree) Checkpoint() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return b.failed
+	}
+	return b.checkpoint()
+}
+
+// checkpoint is Checkpoint without the lock.
+func (b *BTree) checkpoint() error {
+	return b.checkpointKeys(b.keyState())
+}
+
+// checkpointKeys is checkpoint recording the given key state in the
+// superblock instead of the current one, see keyState.
+func (b *BTree) checkpointKeys(keys keyState) error {
+	// Let the queued records reach the log first, so that no batch is
+	// written concurrently with the truncation
+	if err := b.wal.flush(); err != nil {
+		return err
+	}
+	if err := b.writeRoot(keys); err != nil {
+		return fmt.Errorf("checkpoint failed: %w", err)
+	}
+
+	if err := b.logFile.Truncate(logHeaderSize); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+	if err := b.logFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log: %w", err)
+	}
+	b.logSize = logHeaderSize
+	b.wal.checkpointed(b.lsn)
+	return nil
+}
+
+// commitOp finishes a write that has been applied to the tree: it queues the
+// log record and checkpoints once the log has grown past checkpointLogSize.
+// It returns the LSN the caller waits on with waitDurable.
+func (b *BTree) commitOp(entry LogEntry) (uint64, error) {
+	b.modCount++
+
+	lsn, err := b.logOperation(entry)
+	if err != nil {
+		return 0, b.abort(fmt.Errorf("failed to log %s: %w", entry.Operation, err))
+	}
+
+	if b.checkpointLogSize > 0 && b.logSize >= b.checkpointLogSize {
+		// The operation is already in the log; a failed checkpoint is
+		// simply retried after the next write
+		if err := b.checkpoint(); err != nil {
+			fmt.Printf("Checkpoint failed: %v\n", err)
+		}
+	}
+	return lsn, nil
+}
+
+// checkpointLoop checkpoints at every interval while there are operations
+// logged since the last checkpoint, until stop is closed.
+func (b *BTree) checkpointLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			if b.failed == nil && b.lsn > b.pager.meta.lsn {
+				if err := b.checkpoint(); err != nil {
+					fmt.Printf("Checkpoint failed: %v\n", err)
+				}
+			}
+			b.mu.Unlock()
+		}
+	}
+}
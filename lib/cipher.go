@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite selects the AEAD values and key names are sealed with. It is
+// chosen when a database is created and recorded in its header page, and
+// every value records the suite it was sealed with, see valueFormat.
+type CipherSuite byte
+
+const (
+	// CipherSuiteDefault uses the suite recorded in an existing database, or
+	// CipherSuiteXChaCha20Poly1305 for a new one.
+	CipherSuiteDefault CipherSuite = 0x00
+	// CipherSuiteXChaCha20Poly1305 seals values with XChaCha20-Poly1305
+	// under random 24-byte nonces.
+	CipherSuiteXChaCha20Poly1305 CipherSuite = 0x01
+	// CipherSuiteAES256GCM seals values with AES-256-GCM under random
+	// 12-byte nonces. Random nonces of that size limit a key to about 2^32
+	// writes, so keys should be rotated well before that, see
+	// RotateEncryptionKey.
+	CipherSuiteAES256GCM CipherSuite = 0x02
+)
+
+// ErrCipherSuiteMismatch is returned when a database is opened with a cipher
+// suite other than the one it was created with.
+var ErrCipherSuiteMismatch = errors.New("cipher suite does not match the database")
+
+// String returns the name of the cipher suite.
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherSuiteDefault:
+		return "default"
+	case CipherSuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	case CipherSuiteAES256GCM:
+		return "aes-256-gcm"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(s))
+	}
+}
+
+// aeadSuite is an implementation of a cipher suite.
+type aeadSuite interface {
+	// newAEAD returns the AEAD for a 32-byte key.
+	newAEAD(key []byte) (cipher.AEAD, error)
+}
+
+type xchachaSuite struct{}
+
+func (xchachaSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+type aesGCMSuite struct{}
+
+func (aesGCMSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES-256-GCM key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// suites maps each cipher suite to its implementation.
+var suites = map[CipherSuite]aeadSuite{
+	CipherSuiteXChaCha20Poly1305: xchachaSuite{},
+	CipherSuiteAES256GCM:         aesGCMSuite{},
+}
+
+// newAEAD returns the AEAD of the suite for key.
+func (s CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	impl, ok := suites[s]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher suite %s", s)
+	}
+	return impl.newAEAD(key)
+}
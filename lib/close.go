@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrClosed is returned by every operation on a tree after Close.
+var ErrClosed = errors.New("tree is closed")
+
+// Close waits for a running compaction to finish and checkpoints the tree:
+// every dirty node in the cache is flushed, the root is committed and the log
+// is truncated. It then stops the background checkpoints, expiry sweep, key
+// rotations and re-indexing, syncs and closes both files, and zeroes the key
+// material held by the tree. Later calls, and every other operation, return
+// ErrClosed.
+//
+// ctx bounds the wait for a running compaction; if it ends first, Close
+// returns its error and the tree stays open with its background work running.
+// If the final checkpoint fails, the tree also stays open and Close can be
+// called again. A tree that needs
+// recovery, see ErrNeedsRecovery, is closed without a checkpoint, leaving the
+// log to be replayed when it is reopened.
+func (b *BTree) Close(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	for b.compacting != nil {
+		done := b.compacting
+		b.mu.Unlock()
+		select {
+		case <-done:
+			b.mu.Lock()
+		case <-ctx.Done():
+			b.mu.Lock()
+			return ctx.Err()
+		}
+		if b.closed {
+			return ErrClosed
+		}
+	}
+
+	var err error
+	if b.failed == nil {
+		if err := b.checkpoint(); err != nil {
+			return err
+		}
+	} else {
+		err = b.wal.flush()
+	}
+	// Close can no longer fail and leave the tree open; background work
+	// waiting for the lock sees it stopped once it gets it
+	b.stopBackground()
+	b.wal.stopSyncLoop()
+
+	for _, file := range []*os.File{b.dbFile, b.logFile} {
+		if syncErr := file.Sync(); syncErr != nil && err == nil {
+			err = fmt.Errorf("failed to sync %s: %w", file.Name(), syncErr)
+		}
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close %s: %w", file.Name(), closeErr)
+		}
+	}
+
+	b.closed = true
+	b.failed = ErrClosed
+	b.cache.Reset()
+	b.zeroKeys()
+	return err
+}
+
+// stopBackground stops the checkpoint loop, the expiry sweep and the sweeps of key rotations.
+// A stopped sweep can be resumed by starting the rotation again.
+func (b *BTree) stopBackground() {
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	if r := b.rotation.Load(); r != nil {
+		r.stop = nil
+	}
+	if r := b.hmacRotation.Load(); r != nil {
+		r.stop = nil
+	}
+}
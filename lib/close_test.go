@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestClosedTree checks that every operation on a closed tree returns ErrClosed.
+func TestClosedTree(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestTree(t, dir, 10, KeyModeHMAC)
+	if err := b.Insert("key", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	closeTestTree(t, b)
+
+	batch := &WriteBatch{}
+	batch.Put("other", []byte("value"))
+	ops := map[string]func() error{
+		"Close":  func() error { return b.Close(context.Background()) },
+		"Insert": func() error { return b.Insert("key", []byte("value")) },
+		"Update": func() error { return b.Update("key", []byte("value")) },
+		"Delete": func() error { return b.Delete("key") },
+		"Put":    func() error { return b.Put("key", []byte("value"), PutUpsert) },
+		"Write":  func() error { return b.Write(batch) },
+		"Read": func() error {
+			_, err := b.Read("key")
+			return err
+		},
+		"ReadWithVersion": func() error {
+			_, _, err := b.ReadWithVersion("key")
+			return err
+		},
+		"CompareAndSwap": func() error {
+			_, err := b.CompareAndSwap("key", 1, []byte("value"))
+			return err
+		},
+		"InsertIfAbsent": func() error {
+			_, err := b.InsertIfAbsent("other", []byte("value"))
+			return err
+		},
+		"IncrBy": func() error {
+			_, err := b.IncrBy("key", 1)
+			return err
+		},
+		"DecrBy": func() error {
+			_, err := b.DecrBy("key", 1)
+			return err
+		},
+		"IncrByFloat": func() error {
+			_, err := b.IncrByFloat("key", 1)
+			return err
+		},
+		"InsertWithTTL": func() error { return b.InsertWithTTL("key", []byte("value"), time.Hour) },
+		"Expire":        func() error { return b.Expire("key", time.Hour) },
+		"Persist":       func() error { return b.Persist("key") },
+		"TTL": func() error {
+			_, err := b.TTL("key")
+			return err
+		},
+		"ListKeys": func() error {
+			_, err := b.ListKeys()
+			return err
+		},
+		"Keys": func() error {
+			_, err := b.Keys("*")
+			return err
+		},
+		"Range": func() error {
+			it := b.Range("", "", 0, false)
+			if it.Next() {
+				return nil
+			}
+			return it.Err()
+		},
+		"Cursor": func() error {
+			c := b.NewCursor()
+			if c.First() {
+				return nil
+			}
+			return c.Err()
+		},
+		"Checkpoint": b.Checkpoint,
+		"Compact": func() error {
+			_, err := b.Compact()
+			return err
+		},
+		"SetDurability":       func() error { return b.SetDurability(DurabilityAlways, 0) },
+		"RotateEncryptionKey": func() error { return b.RotateEncryptionKey(bytes.Repeat([]byte{0x44}, 32)) },
+		"RotateHMACKey":       func() error { return b.RotateHMACKey(bytes.Repeat([]byte{0x55}, 32)) },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s on a closed tree returned %v", name, err)
+		}
+	}
+}
+
+// TestFailedClose checks that a tree whose Close failed stays open with its
+// background checkpoints and expiry sweep running.
+func TestFailedClose(t *testing.T) {
+	opts := Options{CheckpointInterval: 5 * time.Millisecond, ExpiryInterval: 5 * time.Millisecond, Durability: DurabilityNone}
+	b, err := NewBTreeWithOptions(3, t.TempDir(), "", "", StaticKeys(testHMACKey, testEncryptionKey, nil), 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close gives up waiting for a compaction that does not finish
+	done := make(chan struct{})
+	b.mu.Lock()
+	b.compacting = done
+	b.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Close(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if err := b.Insert("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.InsertWithTTL("expiring", []byte("value"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	expiring := b.indexKey("expiring")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.RLock()
+		swept := b.search(b.root, expiring) == nil
+		checkpointed := b.pager.meta.lsn == b.lsn
+		b.mu.RUnlock()
+		if swept && checkpointed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background work stopped by the failed Close: swept %v, checkpointed %v", swept, checkpointed)
+		}
+	}
+	if value, err := b.Read("key"); err != nil || string(value) != "value" {
+		t.Fatalf("read %q, %v", value, err)
+	}
+
+	b.mu.Lock()
+	b.compacting = nil
+	close(done)
+	b.mu.Unlock()
+	closeTestTree(t, b)
+}
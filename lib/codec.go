@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Nodes and log records are stored in a binary layout that can be parsed
+// without the Go types. Integers are unsigned varints as produced by
+// binary.AppendUvarint, and byte strings are a varint length followed by the
+// bytes; an empty byte string decodes to nil.
+//
+// A node, stored in its page chain (see pager):
+//
+//	byte      flags, bit 0 set for a leaf
+//	varint    number of keys
+//	          each key-value pair, see below
+//	varint    number of children, zero for a leaf
+//	varint    page id of each child; its offset is the page id times the page size
+//
+// A key-value pair:
+//
+//	varint    flags, bit 0 set when the encrypted key name is present, bit 1
+//	          when the expiry time is, bit 2 when the version is
+//	bytes     index key, the form the key is stored under, see KeyMode
+//	bytes     encrypted value
+//	bytes     encrypted key name, only if flag bit 0 is set
+//	varint    expiry time in Unix nanoseconds, only if flag bit 1 is set
+//	varint    version, only if flag bit 2 is set
+//
+// A log record payload, framed as described in logrecord.go:
+//
+//	varint    flags, bit 0 set when the index key is present, bit 1 when
+//	          the encrypted key name is, bit 2 when the expiry time is
+//	bytes     operation, such as "CREATE"
+//	bytes     key, as given by the caller
+//	bytes     value
+//	bytes     index key the value was sealed for, only if flag bit 0 is set
+//	bytes     encrypted key name, only if flag bit 1 is set
+//	varint    expiry time in Unix nanoseconds, only if flag bit 2 is set
+//	varint    number of operations of a BATCH record, each encoded as a payload
+//
+// Flag bits not listed are reserved for optional fields and must be zero.
+
+// Node and key-value flags.
+const (
+	nodeFlagLeaf    byte   = 1 << 0
+	kvFlagKeyName   uint64 = 1 << 0
+	kvFlagExpires   uint64 = 1 << 1
+	kvFlagVersion   uint64 = 1 << 2
+	kvFlagsKnown           = kvFlagKeyName | kvFlagExpires | kvFlagVersion
+	logFlagIndexKey uint64 = 1 << 0
+	logFlagKeyName  uint64 = 1 << 1
+	logFlagExpires  uint64 = 1 << 2
+	logFlagsKnown          = logFlagIndexKey | logFlagKeyName | logFlagExpires
+)
+
+// errShortData is returned when an encoding ends before its last field.
+var errShortData = errors.New("encoding is truncated")
+
+// encodeNode serializes a node for storage in its page chain.
+func encodeNode(node *Node) ([]byte, error) {
+	size := 1 + 2*binary.MaxVarintLen64 + len(node.children)*binary.MaxVarintLen32
+	for _, kv := range node.keys {
+		size += 4*binary.MaxVarintLen32 + 2*binary.MaxVarintLen64 + len(kv.Key) + len(kv.Value) + len(kv.EncryptedKey)
+	}
+
+	buf := make([]byte, 0, size)
+	var flags byte
+	if node.isLeaf {
+		flags |= nodeFlagLeaf
+	}
+	buf = append(buf, flags)
+
+	buf = binary.AppendUvarint(buf, uint64(len(node.keys)))
+	for _, kv := range node.keys {
+		var kvFlags uint64
+		if kv.EncryptedKey != nil {
+			kvFlags |= kvFlagKeyName
+		}
+		if kv.ExpiresAt != 0 {
+			kvFlags |= kvFlagExpires
+		}
+		if kv.Version != 0 {
+			kvFlags |= kvFlagVersion
+		}
+		buf = binary.AppendUvarint(buf, kvFlags)
+		buf = appendBytes(buf, []byte(kv.Key))
+		buf = appendBytes(buf, kv.Value)
+		if kv.EncryptedKey != nil {
+			buf = appendBytes(buf, kv.EncryptedKey)
+		}
+		if kv.ExpiresAt != 0 {
+			buf = binary.AppendUvarint(buf, uint64(kv.ExpiresAt))
+		}
+		if kv.Version != 0 {
+			buf = binary.AppendUvarint(buf, kv.Version)
+		}
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(node.children)))
+	for _, child := range node.children {
+		if child%pageSize != 0 {
+			return nil, fmt.Errorf("child offset %d is not page aligned", child)
+		}
+		buf = binary.AppendUvarint(buf, uint64(child/pageSize))
+	}
+	return buf, nil
+}
+
+// decodeNode deserializes a node read from its page chain. The node shares
+// its byte slices with data.
+func decodeNode(data []byte) (*Node, error) {
+	d := decoder{data: data}
+	flags := d.byte()
+	if flags&^nodeFlagLeaf != 0 {
+		return nil, fmt.Errorf("unknown node flags %#x", flags)
+	}
+	node := &Node{isLeaf: flags&nodeFlagLeaf != 0}
+
+	n := d.count()
+	node.keys = make([]*KeyValue, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		kvFlags := d.uvarint()
+		if kvFlags&^kvFlagsKnown != 0 {
+			return nil, fmt.Errorf("unknown key flags %#x", kvFlags)
+		}
+		kv := &KeyValue{Key: string(d.bytes()), Value: d.bytes()}
+		if kvFlags&kvFlagKeyName != 0 {
+			kv.EncryptedKey = d.bytes()
+		}
+		if kvFlags&kvFlagExpires != 0 {
+			kv.ExpiresAt = int64(d.uvarint())
+		}
+		if kvFlags&kvFlagVersion != 0 {
+			kv.Version = d.uvarint()
+		}
+		node.keys = append(node.keys, kv)
+	}
+	node.numKeys = len(node.keys)
+
+	if m := d.count(); m > 0 {
+		node.children = make([]int64, 0, m)
+		for i := 0; i < m && d.err == nil; i++ {
+			node.children = append(node.children, int64(d.uvarint())*pageSize)
+		}
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// appendLogPayload appends the payload of a log entry to buf.
+func appendLogPayload(buf []byte, entry LogEntry) []byte {
+	var flags uint64
+	if entry.IndexKey != "" {
+		flags |= logFlagIndexKey
+	}
+	if entry.EncryptedKey != nil {
+		flags |= logFlagKeyName
+	}
+	if entry.ExpiresAt != 0 {
+		flags |= logFlagExpires
+	}
+	buf = binary.AppendUvarint(buf, flags)
+	buf = appendBytes(buf, []byte(entry.Operation))
+	buf = appendBytes(buf, []byte(entry.Key))
+	buf = appendBytes(buf, entry.Value)
+	if entry.IndexKey != "" {
+		buf = appendBytes(buf, []byte(entry.IndexKey))
+	}
+	if entry.EncryptedKey != nil {
+		buf = appendBytes(buf, entry.EncryptedKey)
+	}
+	if entry.ExpiresAt != 0 {
+		buf = binary.AppendUvarint(buf, uint64(entry.ExpiresAt))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Ops)))
+	for _, op := range entry.Ops {
+		buf = appendLogPayload(buf, op)
+	}
+	return buf
+}
+
+// decodeLogPayload returns the log entry a payload was made from, without LSN
+// and timestamp.
+func decodeLogPayload(data []byte) (LogEntry, error) {
+	d := decoder{data: data}
+	entry := d.logEntry()
+	if err := d.finish(); err != nil {
+		return LogEntry{}, err
+	}
+	return entry, nil
+}
+
+// appendBytes appends a length-prefixed byte string to buf.
+func appendBytes(buf, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// decoder reads the fields of an encoding in order. After the first error,
+// every read returns a zero value and the error is kept in err.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		d.fail(errShortData)
+		return 0
+	}
+	c := d.data[0]
+	d.data = d.data[1:]
+	return c
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(errShortData)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads a number of following items, each taking at least one byte.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail(errShortData)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) logEntry() LogEntry {
+	flags := d.uvarint()
+	if flags&^logFlagsKnown != 0 {
+		d.fail(fmt.Errorf("unknown log record flags %#x", flags))
+	}
+	entry := LogEntry{Operation: string(d.bytes()), Key: string(d.bytes()), Value: d.bytes()}
+	if flags&logFlagIndexKey != 0 {
+		entry.IndexKey = string(d.bytes())
+	}
+	if flags&logFlagKeyName != 0 {
+		entry.EncryptedKey = d.bytes()
+	}
+	if flags&logFlagExpires != 0 {
+		entry.ExpiresAt = int64(d.uvarint())
+	}
+	n := d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		entry.Ops = append(entry.Ops, d.logEntry())
+	}
+	return entry
+}
+
+// finish returns the first error, or an error if bytes are left over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d unexpected trailing bytes", len(d.data))
+	}
+	return d.err
+}
@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testNode returns an internal node whose key-value pairs cover every
+// combination of optional fields.
+func testNode() *Node {
+	node := &Node{}
+	for i := 0; i < 8; i++ {
+		kv := &KeyValue{Key: fmt.Sprintf("%064x", i), Value: bytes.Repeat([]byte{byte(i + 1)}, 60)}
+		if i&1 != 0 {
+			kv.EncryptedKey = bytes.Repeat([]byte{0xee}, 40)
+		}
+		if i&2 != 0 {
+			kv.ExpiresAt = time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano()
+		}
+		if i&4 != 0 {
+			kv.Version = uint64(1000 + i)
+		}
+		node.keys = append(node.keys, kv)
+		node.children = append(node.children, (int64(i)+int64(firstDataPage))*pageSize)
+	}
+	node.children = append(node.children, 1<<40*pageSize)
+	node.numKeys = len(node.keys)
+	return node
+}
+
+// testLogEntries returns log entries covering every combination of optional
+// fields, and a BATCH holding all of them.
+func testLogEntries() []LogEntry {
+	var entries []LogEntry
+	for i := 0; i < 8; i++ {
+		entry := LogEntry{Operation: "CREATE", Key: fmt.Sprint("key-", i), Value: []byte(fmt.Sprint("value-", i))}
+		if i&1 != 0 {
+			entry.IndexKey = fmt.Sprintf("%064x", i)
+		}
+		if i&2 != 0 {
+			entry.EncryptedKey = bytes.Repeat([]byte{0xee}, 40)
+		}
+		if i&4 != 0 {
+			entry.ExpiresAt = time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano()
+		}
+		entries = append(entries, entry)
+	}
+	entries = append(entries, LogEntry{Operation: "DELETE", Key: "gone"})
+	batch := LogEntry{Operation: "BATCH", Ops: append([]LogEntry(nil), entries...)}
+	return append(entries, batch)
+}
+
+// checkNode fails the test unless got holds the same node as want. Empty and
+// nil slices are equal.
+func checkNode(t *testing.T, got, want *Node) {
+	t.Helper()
+	if got.isLeaf != want.isLeaf || got.numKeys != want.numKeys || len(got.keys) != len(want.keys) || len(got.children) != len(want.children) {
+		t.Fatalf("decoded node %+v, expected %+v", got, want)
+	}
+	for i, kv := range want.keys {
+		if !reflect.DeepEqual(got.keys[i], kv) {
+			t.Fatalf("decoded key-value pair %+v, expected %+v", got.keys[i], kv)
+		}
+	}
+	for i, child := range want.children {
+		if got.children[i] != child {
+			t.Fatalf("decoded child %d, expected %d", got.children[i], child)
+		}
+	}
+}
+
+func TestNodeRoundTrip(t *testing.T) {
+	leaf := testNode()
+	leaf.isLeaf, leaf.children = true, nil
+	for _, node := range []*Node{testNode(), leaf, {isLeaf: true}} {
+		data, err := encodeNode(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeNode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNode(t, decoded, node)
+	}
+}
+
+func TestNodeRejectsInvalidEncodings(t *testing.T) {
+	data, err := encodeNode(testNode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i++ {
+		if _, err := decodeNode(data[:i]); err == nil {
+			t.Fatalf("node truncated to %d of %d bytes was decoded", i, len(data))
+		}
+	}
+	if _, err := decodeNode(append(bytes.Clone(data), 0)); err == nil {
+		t.Fatal("node with a trailing byte was decoded")
+	}
+
+	unknownNode := bytes.Clone(data)
+	unknownNode[0] |= 1 << 1
+	if _, err := decodeNode(unknownNode); err == nil {
+		t.Fatal("node with an unknown flag was decoded")
+	}
+
+	// The flags of the first key-value pair follow the node flags and the key count
+	unknownKV := bytes.Clone(data)
+	unknownKV[2] |= 1 << 3
+	if _, err := decodeNode(unknownKV); err == nil {
+		t.Fatal("key-value pair with an unknown flag was decoded")
+	}
+
+	if _, err := encodeNode(&Node{children: []int64{pageSize + 1}}); err == nil {
+		t.Fatal("unaligned child offset was encoded")
+	}
+}
+
+func TestLogPayloadRoundTrip(t *testing.T) {
+	for _, entry := range testLogEntries() {
+		decoded, err := decodeLogPayload(appendLogPayload(nil, entry))
+		if err != nil {
+			t.Fatalf("%s %s: %v", entry.Operation, entry.Key, err)
+		}
+		if !reflect.DeepEqual(decoded, entry) {
+			t.Fatalf("decoded %+v, expected %+v", decoded, entry)
+		}
+	}
+}
+
+func TestLogPayloadRejectsInvalidEncodings(t *testing.T) {
+	entries := testLogEntries()
+	data := appendLogPayload(nil, entries[len(entries)-1])
+	for i := 0; i < len(data); i++ {
+		if _, err := decodeLogPayload(data[:i]); err == nil {
+			t.Fatalf("payload truncated to %d of %d bytes was decoded", i, len(data))
+		}
+	}
+	if _, err := decodeLogPayload(append(bytes.Clone(data), 0)); err == nil {
+		t.Fatal("payload with a trailing byte was decoded")
+	}
+
+	unknown := binary.AppendUvarint(nil, 1<<3)
+	unknown = append(unknown, appendLogPayload(nil, entries[0])[1:]...)
+	if _, err := decodeLogPayload(unknown); err == nil {
+		t.Fatal("payload with an unknown flag was decoded")
+	}
+}
+
+// gobNode is a node in encoding/gob, for comparison with the binary layout.
+type gobNode struct {
+	Keys     []*KeyValue
+	Children []int64
+	IsLeaf   bool
+}
+
+// encodeGobNode returns the gob form of a node.
+func encodeGobNode(b *testing.B, node *Node) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gobNode{Keys: node.keys, Children: node.children, IsLeaf: node.isLeaf}); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkEncodeNode(b *testing.B) {
+	node := testNode()
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := encodeNode(node); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("gob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			encodeGobNode(b, node)
+		}
+	})
+}
+
+func BenchmarkDecodeNode(b *testing.B) {
+	node := testNode()
+	data, err := encodeNode(node)
+	if err != nil {
+		b.Fatal(err)
+	}
+	gobData := encodeGobNode(b, node)
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeNode(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("gob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var record gobNode
+			if err := gob.NewDecoder(bytes.NewReader(gobData)).Decode(&record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrCompactionRunning is returned when Compact is called while another compaction is in progress.
+var ErrCompactionRunning = errors.New("compaction already running")
+
+// CompactionResult reports the outcome of a compaction.
+type CompactionResult struct {
+	OldSize   int64         // Size of the database file before compaction, in bytes
+	NewSize   int64         // Size of the compacted database file, in bytes
+	Reclaimed int64         // Bytes returned to the file system
+	Nodes     int           // Number of live nodes written to the new file
+	Duration  time.Duration // Time taken by the whole compaction
+}
+
+// Compact rewrites the live tree into a new database file and atomically
+// replaces the current file with it, returning the space held by dead pages
+// to the file system.
+//
+// The bulk of the work runs without the tree lock: the tree as of the last
+// checkpoint is pinned so none of its pages are reused, and it is copied while
+// reads and writes continue. Once the copy is done the lock is taken briefly
+// to checkpoint and copy the nodes written in the meantime. Because the tree is copy-on-write, any page
+// still reachable from the new root that was part of the snapshot holds the
+// same subtree and is not copied again.
+func (b *BTree) Compact() (CompactionResult, error) {
+	var result CompactionResult
+	started := time.Now()
+
+	b.mu.Lock()
+	if b.failed != nil {
+		b.mu.Unlock()
+		return result, b.failed
+	}
+	if b.compacting != nil {
+		b.mu.Unlock()
+		return result, ErrCompactionRunning
+	}
+	done := make(chan struct{})
+	b.compacting = done
+	snapshotRoot := b.pager.meta.root
+	oldPager := b.pager
+	oldPager.pin()
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.compacting = nil
+		close(done)
+		b.mu.Unlock()
+	}()
+
+	dbFilePath := filepath.Join(b.dbPath, b.dbName)
+	tmpPath := dbFilePath + ".compact"
+
+	newFile, newPager, err := b.createCompactFile(tmpPath)
+	if err != nil {
+		oldPager.unpin()
+		return result, err
+	}
+	discard := func(err error) (CompactionResult, error) {
+		newFile.Close()
+		os.Remove(tmpPath)
+		oldPager.unpin()
+		return result, err
+	}
+
+	// Copy the snapshot while writers carry on
+	copied := make(map[uint64]int64)
+	if snapshotRoot != 0 {
+		if _, err := copySubtree(oldPager, newPager, snapshotRoot, copied); err != nil {
+			return discard(fmt.Errorf("failed to copy snapshot: %w", err))
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Catch up with the writes made during the copy
+	if err := b.checkpoint(); err != nil {
+		return discard(err)
+	}
+	var rootOffset int64
+	if root := b.pager.meta.root; root != 0 {
+		rootOffset, err = copySubtree(oldPager, newPager, root, copied)
+		if err != nil {
+			return discard(fmt.Errorf("failed to copy recent changes: %w", err))
+		}
+	}
+	if err := newPager.commit(uint64(rootOffset/pageSize), b.lsn, b.keyState()); err != nil {
+		return discard(err)
+	}
+
+	oldInfo, err := b.dbFile.Stat()
+	if err != nil {
+		return discard(err)
+	}
+	newInfo, err := newFile.Stat()
+	if err != nil {
+		return discard(err)
+	}
+
+	// Swap the files. The rename is atomic, so a crash leaves either the old
+	// or the new file in place, both holding a fully committed tree.
+	if err := os.Rename(tmpPath, dbFilePath); err != nil {
+		return discard(fmt.Errorf("failed to replace database file: %w", err))
+	}
+	syncDir(b.dbPath)
+
+	b.dbFile.Close()
+	b.dbFile = newFile
+	b.pager = newPager
+	b.cache.Reset()
+	clear(b.relocated)
+	b.modCount++
+
+	b.root = nil
+	if err := b.LoadDB(); err != nil {
+		return result, fmt.Errorf("failed to load compacted database: %w", err)
+	}
+
+	result.OldSize = oldInfo.Size()
+	result.NewSize = newInfo.Size()
+	result.Reclaimed = result.OldSize - result.NewSize
+	result.Nodes = len(copied)
+	result.Duration = time.Since(started)
+	return result, nil
+}
+
+// createCompactFile creates an empty database file to compact into.
+func (b *BTree) createCompactFile(path string) (*os.File, *pager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create compaction file: %w", err)
+	}
+	p, err := newPager(file, b.pager.header)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, nil, err
+	}
+	return file, p, nil
+}
+
+// copySubtree copies the node stored at page id in src, and all nodes below
+// it, into dst and returns the node's new offset. Pages already in copied are
+// reused instead of being copied again.
+func copySubtree(src, dst *pager, id uint64, copied map[uint64]int64) (int64, error) {
+	if offset, ok := copied[id]; ok {
+		return offset, nil
+	}
+
+	data, _, err := src.readChain(id)
+	if err != nil {
+		return 0, err
+	}
+	node, err := decodeNode(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode node at page %d: %w", id, err)
+	}
+
+	for i, child := range node.children {
+		node.children[i], err = copySubtree(src, dst, uint64(child/pageSize), copied)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	data, err = encodeNode(node)
+	if err != nil {
+		return 0, err
+	}
+	newID := dst.allocate()
+	if _, err := dst.writeChain([]uint64{newID}, data); err != nil {
+		return 0, err
+	}
+
+	offset := int64(newID) * pageSize
+	copied[id] = offset
+	return offset, nil
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// TestCompactConcurrentWrites compacts a tree while another goroutine keeps
+// writing to it, and checks that no write is lost, also after a reopen.
+func TestCompactConcurrentWrites(t *testing.T) {
+	const keys = 400
+	dir := t.TempDir()
+	b := openTestTree(t, dir, 10, KeyModeHMAC)
+	model := make(map[string][]byte)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		value := make([]byte, 200)
+		if err := b.Insert(key, value); err != nil {
+			t.Fatal(err)
+		}
+		model[key] = value
+	}
+	// Leave dead pages behind for the compaction to reclaim
+	for i := 0; i < keys; i += 2 {
+		key := fmt.Sprintf("key-%04d", i)
+		if err := b.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(model, key)
+	}
+	if err := b.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rng := rand.New(rand.NewSource(1))
+		for step := 0; ; step++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprintf("key-%04d", rng.Intn(keys))
+			var err error
+			if _, ok := model[key]; ok && rng.Intn(3) == 0 {
+				if err = b.Delete(key); err == nil {
+					delete(model, key)
+				}
+			} else {
+				value := []byte(fmt.Sprint("value-", step))
+				if err = b.Insert(key, value); err == nil {
+					model[key] = value
+				}
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		result, err := b.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && result.NewSize >= result.OldSize {
+			t.Errorf("compaction grew the file from %d to %d bytes", result.OldSize, result.NewSize)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	checkModel(t, b, model, keys)
+	crashed := openTestTree(t, copyDatabase(t, dir), 10, KeyModeHMAC)
+	checkModel(t, crashed, model, keys)
+	closeTestTree(t, crashed)
+	closeTestTree(t, b)
+	b = openTestTree(t, dir, 10, KeyModeHMAC)
+	checkModel(t, b, model, keys)
+	closeTestTree(t, b)
+}
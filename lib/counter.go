@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Counters are ordinary keys whose values hold a number in decimal text, like
+// "42" or "3.5". The counter operations read, change and write the value back
+// under the tree lock, so concurrent increments are never lost, and log the
+// resulting value as one record, so replay stores the same number instead of
+// applying the increment again. A missing or expired key counts as zero, and
+// a counter keeps the expiry time of its key.
+
+// ErrNotInteger is returned when an integer counter operation finds a value
+// that is not a decimal 64-bit integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+// ErrNotFloat is returned when a float counter operation finds a value that
+// is not a finite decimal number.
+var ErrNotFloat = errors.New("value is not a float")
+
+// ErrCounterOverflow is returned when a counter operation would leave the
+// range of its type.
+var ErrCounterOverflow = errors.New("increment would overflow")
+
+// Incr adds one to the integer value of a key and returns the new value.
+func (b *BTree) Incr(key string) (int64, error) {
+	return b.IncrBy(key, 1)
+}
+
+// IncrBy adds delta to the integer value of a key and returns the new value.
+// It returns once the log record is durable.
+func (b *BTree) IncrBy(key string, delta int64) (int64, error) {
+	return b.applyInteger(key, func(n int64) (int64, bool) {
+		return n + delta, (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta)
+	})
+}
+
+// DecrBy subtracts delta from the integer value of a key and returns the new
+// value. It returns once the log record is durable.
+func (b *BTree) DecrBy(key string, delta int64) (int64, error) {
+	return b.applyInteger(key, func(n int64) (int64, bool) {
+		return n - delta, (delta < 0 && n > math.MaxInt64+delta) || (delta > 0 && n < math.MinInt64+delta)
+	})
+}
+
+// applyInteger replaces the integer value of a key with the one fn computes
+// from it, and returns the new value once its log record is durable. fn also
+// reports whether the result overflowed, which leaves the key unchanged.
+func (b *BTree) applyInteger(key string, fn func(n int64) (int64, bool)) (int64, error) {
+	var result int64
+	lsn, err := b.applyCounter(key, func(value []byte, exists bool) ([]byte, error) {
+		var n int64
+		if exists {
+			var err error
+			if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return nil, ErrNotInteger
+			}
+		}
+		var overflow bool
+		if result, overflow = fn(n); overflow {
+			return nil, ErrCounterOverflow
+		}
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := b.waitDurable(lsn); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// IncrByFloat adds delta to the numeric value of a key and returns the new
+// value, which is stored in the shortest decimal form that reads back exactly.
+// It returns once the log record is durable.
+func (b *BTree) IncrByFloat(key string, delta float64) (float64, error) {
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return 0, ErrNotFloat
+	}
+	var result float64
+	lsn, err := b.applyCounter(key, func(value []byte, exists bool) ([]byte, error) {
+		var f float64
+		if exists {
+			var err error
+			f, err = strconv.ParseFloat(string(value), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, ErrNotFloat
+			}
+		}
+		result = f + delta
+		if math.IsInf(result, 0) {
+			return nil, ErrCounterOverflow
+		}
+		return strconv.AppendFloat(nil, result, 'f', -1, 64), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := b.waitDurable(lsn); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// applyCounter replaces the value of a key with the one fn computes from the
+// current value under the tree lock, and returns the LSN of its log record.
+// fn is called with exists unset if the key is missing or expired.
+func (b *BTree) applyCounter(key string, fn func(value []byte, exists bool) ([]byte, error)) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return 0, b.failed
+	}
+
+	item, at := b.find(key)
+	exists := item != nil && !item.expired(time.Now())
+	var value []byte
+	if exists {
+		var err error
+		if value, err = b.decrypt(item.Value, b.valueKeys(), at); err != nil {
+			return 0, err
+		}
+	}
+	newValue, err := fn(value, exists)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.putValue(key, item, at, newValue, putRequest{})
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestCounterLimits checks IncrBy and DecrBy at both ends of the int64 range.
+func TestCounterLimits(t *testing.T) {
+	b := openTestTree(t, t.TempDir(), 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	tests := []struct {
+		start    int64
+		op       func(key string, delta int64) (int64, error)
+		name     string
+		delta    int64
+		want     int64
+		overflow bool
+	}{
+		{math.MaxInt64 - 1, b.IncrBy, "IncrBy", 1, math.MaxInt64, false},
+		{math.MaxInt64, b.IncrBy, "IncrBy", 1, 0, true},
+		{math.MinInt64 + 1, b.IncrBy, "IncrBy", -1, math.MinInt64, false},
+		{math.MinInt64, b.IncrBy, "IncrBy", -1, 0, true},
+		{-1, b.IncrBy, "IncrBy", math.MinInt64, 0, true},
+		{math.MinInt64 + 1, b.DecrBy, "DecrBy", 1, math.MinInt64, false},
+		{math.MinInt64, b.DecrBy, "DecrBy", 1, 0, true},
+		{math.MaxInt64 - 1, b.DecrBy, "DecrBy", -1, math.MaxInt64, false},
+		{math.MaxInt64, b.DecrBy, "DecrBy", -1, 0, true},
+		{-1, b.DecrBy, "DecrBy", math.MinInt64, math.MaxInt64, false},
+		{0, b.DecrBy, "DecrBy", math.MinInt64, 0, true},
+		{math.MinInt64, b.DecrBy, "DecrBy", math.MinInt64, 0, false},
+		{math.MaxInt64, b.DecrBy, "DecrBy", math.MaxInt64, 0, false},
+	}
+	for _, tt := range tests {
+		start := strconv.FormatInt(tt.start, 10)
+		if err := b.Insert("n", []byte(start)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := tt.op("n", tt.delta)
+		switch {
+		case tt.overflow && !errors.Is(err, ErrCounterOverflow):
+			t.Errorf("%s(%d) on %d: expected ErrCounterOverflow, got %d, %v", tt.name, tt.delta, tt.start, n, err)
+		case !tt.overflow && (err != nil || n != tt.want):
+			t.Errorf("%s(%d) on %d: got %d, %v, expected %d", tt.name, tt.delta, tt.start, n, err, tt.want)
+		}
+		if tt.overflow {
+			if value, err := b.Read("n"); err != nil || string(value) != start {
+				t.Errorf("%s(%d) on %d that overflowed left %q, %v", tt.name, tt.delta, tt.start, value, err)
+			}
+		}
+	}
+}
+
+// TestConcurrentCounters checks that concurrent increments and decrements of
+// the same key are never lost, also after the log is replayed.
+func TestConcurrentCounters(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestTree(t, dir, 10, KeyModeHMAC)
+
+	const workers, steps = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < steps; i++ {
+				var err error
+				if w%2 == 0 {
+					_, err = b.IncrBy("n", 3)
+				} else {
+					_, err = b.DecrBy("n", 1)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := int64(workers / 2 * steps * (3 - 1))
+	if n, err := b.IncrBy("n", 0); err != nil || n != want {
+		t.Fatalf("counter is %d, %v, expected %d", n, err, want)
+	}
+	crashed := openTestTree(t, copyDatabase(t, dir), 10, KeyModeHMAC)
+	if value, err := crashed.Read("n"); err != nil || string(value) != strconv.FormatInt(want, 10) {
+		t.Fatalf("replayed counter is %q, %v, expected %d", value, err, want)
+	}
+	closeTestTree(t, crashed)
+	closeTestTree(t, b)
+}
@@ -0,0 +1,416 @@
+package lib
+
+import "time"
+
+// Cursor walks the keys of a BTree in order, loading nodes lazily through
+// readNode as it moves. A cursor takes the tree's read lock only while it is
+// repositioning, so it does not block writers between calls. When the tree
+// has been changed since the last move, the cursor re-seeks to the key it was
+// on before continuing, so it never returns a key twice or skips one that is
+// still present.
+//
+// Keys are ordered by the form they are stored in, see KeyMode. In
+// KeyModeHMAC that order is unrelated to the original keys. Expired keys are
+// returned until they are deleted; Iterator leaves them out.
+type Cursor struct {
+	tree     *BTree
+	stack    []cursorFrame // Path from the root to the current key
+	item     KeyValue      // Copy of the current key-value pair
+	valid    bool
+	modCount uint64 // Tree modification count the stack was built against
+	err      error
+}
+
+// cursorFrame is one level of a cursor's path. For the node holding the
+// current key, index is the position of that key; for every node above it,
+// index is the child the path descends into.
+type cursorFrame struct {
+	node  *Node
+	index int
+}
+
+// NewCursor returns an unpositioned cursor over the tree.
+func (b *BTree) NewCursor() *Cursor {
+	return &Cursor{tree: b}
+}
+
+// Valid reports whether the cursor is positioned on a key.
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+// Item returns the key-value pair the cursor is positioned on.
+// The value is returned as stored, use DecryptValue to read it.
+func (c *Cursor) Item() KeyValue {
+	return c.item
+}
+
+// Err returns the first error encountered while reading nodes.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// First moves the cursor to the smallest key in the tree.
+func (c *Cursor) First() bool {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+
+	if c.tree.closed {
+		return c.fail(ErrClosed)
+	}
+	c.reset()
+	return c.descend(c.tree.root, false)
+}
+
+// Last moves the cursor to the largest key in the tree.
+func (c *Cursor) Last() bool {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+
+	if c.tree.closed {
+		return c.fail(ErrClosed)
+	}
+	c.reset()
+	return c.descend(c.tree.root, true)
+}
+
+// Seek moves the cursor to the first key greater than or equal to key.
+func (c *Cursor) Seek(key string) bool {
+	return c.seekIndexKey(c.tree.indexKey(key))
+}
+
+// seekIndexKey is Seek for a key already in its stored form.
+func (c *Cursor) seekIndexKey(key string) bool {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+
+	if c.tree.closed {
+		return c.fail(ErrClosed)
+	}
+	return c.seek(key)
+}
+
+// Next moves the cursor to the following key.
+func (c *Cursor) Next() bool {
+	if !c.valid {
+		return false
+	}
+
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+
+	if c.tree.closed {
+		return c.fail(ErrClosed)
+	}
+	if c.modCount != c.tree.modCount {
+		// The tree changed underneath us; find our place again. If the current
+		// key was removed, the seek already lands on its successor.
+		key := c.item.Key
+		if !c.seek(key) || c.item.Key != key {
+			return c.valid
+		}
+	}
+	return c.next()
+}
+
+// Prev moves the cursor to the preceding key.
+func (c *Cursor) Prev() bool {
+	if !c.valid {
+		return false
+	}
+
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+
+	if c.tree.closed {
+		return c.fail(ErrClosed)
+	}
+	if c.modCount != c.tree.modCount {
+		// The tree changed underneath us; find our place again and step back
+		// from the first key at or after the current one.
+		if !c.seek(c.item.Key) {
+			c.reset()
+			return c.descend(c.tree.root, true)
+		}
+	}
+	return c.prev()
+}
+
+// reset clears the cursor position.
+func (c *Cursor) reset() {
+	c.stack = c.stack[:0]
+	c.valid = false
+	c.item = KeyValue{}
+	c.modCount = c.tree.modCount
+}
+
+// seek positions the cursor on the first key greater than or equal to key.
+func (c *Cursor) seek(key string) bool {
+	c.reset()
+
+	node := c.tree.root
+	for {
+		i := 0
+		for i < node.numKeys && key > node.keys[i].Key {
+			i++
+		}
+		c.stack = append(c.stack, cursorFrame{node: node, index: i})
+
+		if i < node.numKeys && key == node.keys[i].Key {
+			return c.settle()
+		}
+		if node.isLeaf {
+			if i < node.numKeys {
+				return c.settle()
+			}
+			return c.ascendForward()
+		}
+
+		child, err := c.tree.readNode(node.children[i])
+		if err != nil {
+			return c.fail(err)
+		}
+		node = child
+	}
+}
+
+// descend walks from node to its leftmost key, or its rightmost key if last is set.
+func (c *Cursor) descend(node *Node, last bool) bool {
+	for {
+		index := 0
+		if last {
+			index = node.numKeys
+		}
+		if node.isLeaf {
+			if last {
+				index = node.numKeys - 1
+			}
+			c.stack = append(c.stack, cursorFrame{node: node, index: index})
+			if node.numKeys == 0 {
+				c.stack = c.stack[:len(c.stack)-1]
+				if last {
+					return c.ascendBackward()
+				}
+				return c.ascendForward()
+			}
+			return c.settle()
+		}
+
+		c.stack = append(c.stack, cursorFrame{node: node, index: index})
+		child, err := c.tree.readNode(node.children[index])
+		if err != nil {
+			return c.fail(err)
+		}
+		node = child
+	}
+}
+
+// next advances from the current key to its successor.
+func (c *Cursor) next() bool {
+	top := &c.stack[len(c.stack)-1]
+	if !top.node.isLeaf {
+		// The successor is the leftmost key of the right subtree
+		top.index++
+		child, err := c.tree.readNode(top.node.children[top.index])
+		if err != nil {
+			return c.fail(err)
+		}
+		return c.descend(child, false)
+	}
+
+	top.index++
+	if top.index < top.node.numKeys {
+		return c.settle()
+	}
+	c.stack = c.stack[:len(c.stack)-1]
+	return c.ascendForward()
+}
+
+// prev moves from the current key to its predecessor.
+func (c *Cursor) prev() bool {
+	top := &c.stack[len(c.stack)-1]
+	if !top.node.isLeaf {
+		// The predecessor is the rightmost key of the left subtree
+		child, err := c.tree.readNode(top.node.children[top.index])
+		if err != nil {
+			return c.fail(err)
+		}
+		return c.descend(child, true)
+	}
+
+	top.index--
+	if top.index >= 0 {
+		return c.settle()
+	}
+	c.stack = c.stack[:len(c.stack)-1]
+	return c.ascendBackward()
+}
+
+// ascendForward pops finished frames until an ancestor has a key after the
+// subtree just left.
+func (c *Cursor) ascendForward() bool {
+	for len(c.stack) > 0 {
+		top := c.stack[len(c.stack)-1]
+		if top.index < top.node.numKeys {
+			return c.settle()
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	c.valid = false
+	return false
+}
+
+// ascendBackward pops finished frames until an ancestor has a key before the
+// subtree just left.
+func (c *Cursor) ascendBackward() bool {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.index > 0 {
+			top.index--
+			return c.settle()
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	c.valid = false
+	return false
+}
+
+// settle records the key under the top frame as the current item.
+func (c *Cursor) settle() bool {
+	top := c.stack[len(c.stack)-1]
+	c.item = *top.node.keys[top.index]
+	c.valid = true
+	return true
+}
+
+// fail invalidates the cursor and records err.
+func (c *Cursor) fail(err error) bool {
+	c.err = err
+	c.valid = false
+	return false
+}
+
+// Iterator streams the key-value pairs of a key range, leaving out expired
+// keys.
+type Iterator struct {
+	cursor  *Cursor
+	start   string
+	end     string
+	limit   int
+	reverse bool
+	count   int
+	started bool
+	done    bool
+}
+
+// Range returns an iterator over the keys in [start, end). An empty start or
+// end leaves that side of the range open. A positive limit caps the number of
+// pairs returned, and reverse walks the range from the end towards the start.
+// Bounded ranges fail with ErrUnorderedKeys when keys are stored in KeyModeHMAC.
+func (b *BTree) Range(start, end string, limit int, reverse bool) *Iterator {
+	it := &Iterator{
+		cursor:  b.NewCursor(),
+		limit:   limit,
+		reverse: reverse,
+	}
+	if start != "" {
+		it.start = b.indexKey(start)
+	}
+	if end != "" {
+		it.end = b.indexKey(end)
+	}
+	if start != "" || end != "" {
+		it.fail(b.boundsError())
+	}
+	return it
+}
+
+// Prefix returns an iterator over the keys starting with prefix, with the
+// same limit and reverse options as Range.
+func (b *BTree) Prefix(prefix string, limit int, reverse bool) *Iterator {
+	it := b.Range("", "", limit, reverse)
+	if prefix != "" {
+		if err := b.boundsError(); err != nil {
+			it.fail(err)
+			return it
+		}
+		it.start = b.indexKey(prefix)
+		it.end = prefixEnd(it.start)
+	}
+	return it
+}
+
+// boundsError returns why bounded scans are not possible on the tree, or nil if they are.
+func (b *BTree) boundsError() error {
+	if b.keyMode == KeyModeHMAC {
+		return ErrUnorderedKeys
+	}
+	return nil
+}
+
+// fail stops the iterator with err, unless err is nil.
+func (it *Iterator) fail(err error) {
+	if err != nil {
+		it.cursor.err = err
+		it.done = true
+	}
+}
+
+// Next advances the iterator and reports whether a pair is available.
+func (it *Iterator) Next() bool {
+	if it.done || (it.limit > 0 && it.count >= it.limit) {
+		it.done = true
+		return false
+	}
+
+	now := time.Now()
+	for {
+		var ok bool
+		switch {
+		case it.started && it.reverse:
+			ok = it.cursor.Prev()
+		case it.started:
+			ok = it.cursor.Next()
+		case it.reverse && it.end != "":
+			// Step back from the first key at or after the end bound
+			if ok = it.cursor.seekIndexKey(it.end); ok {
+				ok = it.cursor.Prev()
+			} else if it.cursor.Err() == nil {
+				ok = it.cursor.Last()
+			}
+		case it.reverse:
+			ok = it.cursor.Last()
+		case it.start != "":
+			ok = it.cursor.seekIndexKey(it.start)
+		default:
+			ok = it.cursor.First()
+		}
+		it.started = true
+
+		if ok {
+			key := it.cursor.Item().Key
+			if (it.end != "" && key >= it.end) || (it.start != "" && key < it.start) {
+				ok = false
+			}
+		}
+		if !ok {
+			it.done = true
+			return false
+		}
+		if item := it.cursor.Item(); !item.expired(now) {
+			break
+		}
+	}
+	it.count++
+	return true
+}
+
+// Item returns the current key-value pair.
+func (it *Iterator) Item() KeyValue {
+	return it.cursor.Item()
+}
+
+// Err returns the first error encountered during iteration.
+func (it *Iterator) Err() error {
+	return it.cursor.Err()
+}
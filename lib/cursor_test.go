@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// cursorKey returns the i-th key of the cursor tests, in key order.
+func cursorKey(i int) string {
+	return fmt.Sprintf("key-%04d", i)
+}
+
+// TestCursorRepositions checks that Seek, Next and Prev continue from the
+// cursor's key after the tree was changed between moves.
+func TestCursorRepositions(t *testing.T) {
+	b := openTestTree(t, t.TempDir(), 10, KeyModePlain)
+	defer closeTestTree(t, b)
+	for i := 0; i < 200; i += 2 {
+		if err := b.Insert(cursorKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := b.NewCursor()
+	expect := func(ok bool, want string) {
+		t.Helper()
+		if !ok || c.Item().Key != want {
+			t.Fatalf("cursor on %q (%v, %v), expected %q", c.Item().Key, ok, c.Err(), want)
+		}
+	}
+	expect(c.Seek(cursorKey(51)), cursorKey(52))
+
+	// The current key is deleted and its successor inserted
+	if err := b.Delete(cursorKey(52)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Insert(cursorKey(53), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	expect(c.Next(), cursorKey(53))
+
+	// Splits move the current key to another node
+	for i := 55; i < 120; i += 2 {
+		if err := b.Insert(cursorKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(c.Next(), cursorKey(54))
+	expect(c.Next(), cursorKey(55))
+
+	// The current key and its predecessor are deleted
+	for _, i := range []int{54, 55} {
+		if err := b.Delete(cursorKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(c.Prev(), cursorKey(53))
+	expect(c.Prev(), cursorKey(50))
+
+	// Everything from the cursor on is deleted
+	keys, err := b.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if key >= cursorKey(50) {
+			if err := b.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c.Next() {
+		t.Fatalf("cursor moved to %q in an empty tree", c.Item().Key)
+	}
+}
+
+// TestCursorConcurrentWrites walks the tree in both directions while other
+// keys are inserted and deleted, and checks that every key present throughout
+// the walk is returned once, in order.
+func TestCursorConcurrentWrites(t *testing.T) {
+	b := openTestTree(t, t.TempDir(), 10, KeyModePlain)
+	defer closeTestTree(t, b)
+	const keys = 600
+	for i := 0; i < keys; i += 3 {
+		if err := b.Insert(cursorKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, reverse := range []bool{false, true} {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			present := make(map[int]bool)
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Keys not divisible by three come and go
+				i := n * 7 % keys
+				if i%3 == 0 {
+					i++
+				}
+				var err error
+				if present[i] {
+					err = b.Delete(cursorKey(i))
+				} else {
+					err = b.Insert(cursorKey(i), []byte("value"))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				present[i] = !present[i]
+			}
+		}()
+
+		var seen []string
+		c := b.NewCursor()
+		if reverse {
+			for ok := c.Last(); ok; ok = c.Prev() {
+				seen = append(seen, c.Item().Key)
+			}
+		} else {
+			for ok := c.First(); ok; ok = c.Next() {
+				seen = append(seen, c.Item().Key)
+			}
+		}
+		close(stop)
+		wg.Wait()
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		stable := 0
+		for i, key := range seen {
+			if i > 0 && (key <= seen[i-1]) != reverse {
+				t.Fatalf("reverse %v: %q follows %q", reverse, key, seen[i-1])
+			}
+			var n int
+			fmt.Sscanf(key, "key-%d", &n)
+			if n%3 == 0 {
+				stable++
+			}
+		}
+		if stable != keys/3 {
+			t.Fatalf("reverse %v: walk returned %d of the %d keys present throughout", reverse, stable, keys/3)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+)
+
+// Durability selects when records in the operation log are synced to disk.
+// It can be changed at any time with SetDurability.
+type Durability byte
+
+const (
+	// DurabilityAlways syncs the log before a write returns. Concurrent
+	// writers share syncs through group commit.
+	DurabilityAlways Durability = 0x00
+	// DurabilityInterval writes the log before a write returns and syncs it
+	// from a background goroutine at a fixed interval. A crash loses at most
+	// the writes of the last interval.
+	DurabilityInterval Durability = 0x01
+	// DurabilityNone writes the log before a write returns and leaves syncing
+	// to the operating system. Checkpoints still make the tree durable.
+	DurabilityNone Durability = 0x02
+)
+
+// DefaultSyncInterval is the sync interval of DurabilityInterval when none is given.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// String returns the name of the durability mode.
+func (d Durability) String() string {
+	switch d {
+	case DurabilityAlways:
+		return "always"
+	case DurabilityInterval:
+		return "interval"
+	case DurabilityNone:
+		return "none"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(d))
+	}
+}
+
+// DurabilityStats reports how much of the operation log is not yet durable.
+type DurabilityStats struct {
+	Mode            Durability
+	Interval        time.Duration // Sync interval in DurabilityInterval
+	LastLSN         uint64        // LSN of the last logged operation
+	WrittenLSN      uint64        // LSN of the last record written to the log file
+	SyncedLSN       uint64        // LSN of the last record known to be durable
+	UnsyncedRecords uint64        // Operations a crash could lose, LastLSN - SyncedLSN
+	UnsyncedBytes   int64         // Log bytes written but not yet synced
+	UnsyncedFor     time.Duration // Age of the oldest unsynced record, 0 if none
+	LastSync        time.Time     // When the log was last synced or checkpointed
+	Syncs           uint64        // Syncs of the log since the tree was opened; with group commit, one covers many writes
+}
+
+// SetDurability changes when the operation log is synced. interval is only
+// used by DurabilityInterval; zero or less selects DefaultSyncInterval.
+// Switching to DurabilityAlways syncs the records written so far.
+func (b *BTree) SetDurability(mode Durability, interval time.Duration) error {
+	// Close stops the sync loop under the write lock
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if err := b.wal.setMode(mode, interval); err != nil {
+		return err
+	}
+	if mode == DurabilityAlways {
+		return b.wal.sync()
+	}
+	return nil
+}
+
+// DurabilityStats returns the current durability mode and the unsynced window of the log.
+func (b *BTree) DurabilityStats() DurabilityStats {
+	w := b.wal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := DurabilityStats{
+		Mode:            w.mode,
+		Interval:        w.interval,
+		LastLSN:         w.queued,
+		WrittenLSN:      w.written,
+		SyncedLSN:       w.synced,
+		UnsyncedRecords: w.queued - min(w.synced, w.queued),
+		UnsyncedBytes:   w.writtenBytes - w.syncedBytes,
+		LastSync:        w.lastSync,
+		Syncs:           w.syncs,
+	}
+	if !w.unsyncedSince.IsZero() {
+		stats.UnsyncedFor = time.Since(w.unsyncedSince)
+	}
+	return stats
+}
+
+// setMode switches the durability mode, starting or stopping the sync loop.
+func (w *logWriter) setMode(mode Durability, interval time.Duration) error {
+	if mode > DurabilityNone {
+		return fmt.Errorf("unknown durability mode %d", mode)
+	}
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stop != nil && (mode != DurabilityInterval || interval != w.interval) {
+		close(w.stop)
+		w.stop = nil
+	}
+	w.mode = mode
+	w.interval = 0
+	if mode == DurabilityInterval {
+		w.interval = interval
+		if w.stop == nil {
+			w.stop = make(chan struct{})
+			go w.syncLoop(interval, w.stop)
+		}
+	}
+	// Writers waiting for a sync may already be covered under the new mode
+	w.cond.Broadcast()
+	return nil
+}
+
+// syncLoop syncs the log at every interval until stop is closed.
+func (w *logWriter) syncLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.sync(); err != nil {
+				fmt.Printf("Failed to sync log: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+// stopSyncLoop stops the sync loop if it is running.
+func (w *logWriter) stopSyncLoop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestDurabilityModes checks the unsynced window reported in each durability
+// mode, and that switching modes at runtime takes effect.
+func TestDurabilityModes(t *testing.T) {
+	b := openTestTree(t, t.TempDir(), 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	insert := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := b.Insert(fmt.Sprintf("key-%04d", i), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// DurabilityNone writes the log but leaves every record unsynced
+	before := b.DurabilityStats()
+	insert(0, 5)
+	stats := b.DurabilityStats()
+	if stats.Mode != DurabilityNone || stats.Syncs != before.Syncs {
+		t.Fatalf("DurabilityNone synced the log: %+v", stats)
+	}
+	if stats.WrittenLSN != stats.LastLSN || stats.UnsyncedRecords != stats.LastLSN-before.SyncedLSN || stats.UnsyncedBytes <= 0 || stats.UnsyncedFor <= 0 {
+		t.Fatalf("unexpected unsynced window: %+v", stats)
+	}
+
+	// DurabilityInterval syncs from the background
+	if err := b.SetDurability(DurabilityInterval, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	insert(5, 10)
+	deadline := time.Now().Add(5 * time.Second)
+	for stats = b.DurabilityStats(); stats.UnsyncedRecords != 0; stats = b.DurabilityStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("interval sync did not run: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats.Mode != DurabilityInterval || stats.Interval != 10*time.Millisecond || stats.Syncs == before.Syncs {
+		t.Fatalf("unexpected stats in DurabilityInterval: %+v", stats)
+	}
+	if stats.UnsyncedBytes != 0 || stats.UnsyncedFor != 0 || stats.SyncedLSN != stats.LastLSN {
+		t.Fatalf("synced log still reports an unsynced window: %+v", stats)
+	}
+
+	// Switching to DurabilityAlways syncs what was written under DurabilityNone
+	if err := b.SetDurability(DurabilityNone, 0); err != nil {
+		t.Fatal(err)
+	}
+	insert(10, 15)
+	if stats = b.DurabilityStats(); stats.UnsyncedRecords == 0 {
+		t.Fatalf("DurabilityNone synced the log: %+v", stats)
+	}
+	if err := b.SetDurability(DurabilityAlways, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats = b.DurabilityStats(); stats.UnsyncedRecords != 0 || stats.Interval != 0 {
+		t.Fatalf("switching to DurabilityAlways did not sync the log: %+v", stats)
+	}
+
+	// DurabilityAlways syncs before every write returns
+	for i := 15; i < 20; i++ {
+		insert(i, i+1)
+		if stats = b.DurabilityStats(); stats.UnsyncedRecords != 0 || stats.SyncedLSN != stats.LastLSN {
+			t.Fatalf("write returned before the log was synced: %+v", stats)
+		}
+	}
+
+	if err := b.SetDurability(DurabilityNone+1, 0); err == nil {
+		t.Fatal("unknown durability mode was accepted")
+	}
+	if stats = b.DurabilityStats(); stats.Mode != DurabilityAlways {
+		t.Fatalf("unknown durability mode changed the mode to %v", stats.Mode)
+	}
+}
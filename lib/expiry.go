@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A key can be given an expiry time, which is stored with its entry. Once it
+// has passed, the key is treated as absent: Read reports it as not found and
+// deletes it, and iterators leave it out. Expired keys that are not read are
+// deleted by a background sweep, which visits a bounded number of keys every
+// Options.ExpiryInterval, continuing where it stopped and starting over at the
+// end of the tree. Every deletion is logged as a DELETE record, so replay and
+// anyone following the log see the same keys go.
+//
+// Setting or clearing an expiry time is logged as an EXPIRE record holding the
+// whole entry, which replay stores like a put.
+
+// DefaultExpiryInterval is the interval of the expiry sweep when
+// Options.ExpiryInterval is zero.
+const DefaultExpiryInterval = time.Second
+
+// expirySampleSize is the number of keys the expiry sweep visits at a time.
+const expirySampleSize = 256
+
+// NoExpiry is returned by TTL for a key without an expiry time.
+const NoExpiry time.Duration = -1
+
+// ErrInvalidTTL is returned for a time to live that is not positive.
+var ErrInvalidTTL = errors.New("time to live must be positive")
+
+// expired reports whether the expiry time of kv has passed at now.
+func (kv *KeyValue) expired(now time.Time) bool {
+	return kv.ExpiresAt != 0 && kv.ExpiresAt <= now.UnixNano()
+}
+
+// InsertWithTTL inserts a key-value pair like Insert, expiring the key once
+// ttl has passed.
+func (b *BTree) InsertWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	lsn, err := b.applyPut(key, value, putRequest{expiresAt: time.Now().Add(ttl).UnixNano(), setExpiry: true})
+	if err != nil {
+		return err
+	}
+	return b.waitDurable(lsn)
+}
+
+// Expire sets a key to expire once ttl has passed, replacing any expiry time
+// it had. It returns once the log record is durable.
+func (b *BTree) Expire(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	lsn, err := b.applyExpire(key, time.Now().Add(ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+	return b.waitDurable(lsn)
+}
+
+// Persist removes the expiry time of a key, so it is kept until deleted.
+// It returns once the log record is durable.
+func (b *BTree) Persist(key string) error {
+	lsn, err := b.applyExpire(key, 0)
+	if err != nil {
+		return err
+	}
+	return b.waitDurable(lsn)
+}
+
+// applyExpire sets the expiry time of a key under the tree lock and returns
+// the LSN of its log record, or zero if the expiry time was unchanged.
+func (b *BTree) applyExpire(key string, expiresAt int64) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return 0, b.failed
+	}
+
+	item, hKey := b.find(key)
+	if item == nil || item.expired(time.Now()) {
+		return 0, errors.New("key not found")
+	}
+	if item.ExpiresAt == expiresAt {
+		return 0, nil
+	}
+
+	stored := *item
+	stored.ExpiresAt = expiresAt
+	stored.Version = b.nextVersion()
+	_, err := b.modifyKey(b.root, hKey, func(kv *KeyValue) error {
+		kv.ExpiresAt = expiresAt
+		kv.Version = stored.Version
+		return nil
+	})
+	if err != nil {
+		return 0, b.abort(err)
+	}
+	return b.commitOp(putEntry("EXPIRE", key, &stored))
+}
+
+// TTL returns the time left until a key expires, or NoExpiry if it has no
+// expiry time.
+func (b *BTree) TTL(key string) (time.Duration, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.failed != nil {
+		return 0, b.failed
+	}
+
+	now := time.Now()
+	item, _ := b.find(key)
+	if item == nil || item.expired(now) {
+		return 0, errors.New("key not found")
+	}
+	if item.ExpiresAt == 0 {
+		return NoExpiry, nil
+	}
+	return time.Unix(0, item.ExpiresAt).Sub(now), nil
+}
+
+// expireKey deletes the entry under an index key found expired by a read,
+// unless it was replaced or deleted in the meantime. The log record is not
+// waited on; the key reads as absent either way.
+func (b *BTree) expireKey(indexKey string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return
+	}
+	item := b.search(b.root, indexKey)
+	if item == nil || !item.expired(time.Now()) {
+		return
+	}
+	if _, err := b.removeExpired(*item); err != nil {
+		fmt.Printf("Failed to delete expired key: %v\n", err)
+	}
+}
+
+// removeExpired deletes an expired entry and logs the deletion under the
+// original key, with the index key it was stored under.
+func (b *BTree) removeExpired(kv KeyValue) (uint64, error) {
+	name, err := b.KeyName(kv)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := b.removeKey(kv.Key); err != nil {
+		return 0, b.abort(err)
+	}
+	entry := LogEntry{Operation: "DELETE", Key: name}
+	if kv.Key != name {
+		entry.IndexKey = kv.Key
+	}
+	return b.commitOp(entry)
+}
+
+// expiryLoop runs the expiry sweep at every interval until stop is closed.
+func (b *BTree) expiryLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	after := ""
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var lsn uint64
+			var err error
+			b.mu.Lock()
+			if b.failed == nil {
+				after, lsn, err = b.expireBatch(after, time.Now())
+			}
+			b.mu.Unlock()
+			if err == nil && lsn != 0 {
+				err = b.waitDurable(lsn)
+			}
+			if err != nil {
+				fmt.Printf("Expiry sweep failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// expireBatch deletes the expired keys among up to expirySampleSize keys
+// following the index key after, or from the first key if after is empty. It
+// returns the key to continue after, empty once the end of the tree was
+// reached, and the LSN of the last deletion logged, if any.
+func (b *BTree) expireBatch(after string, now time.Time) (string, uint64, error) {
+	c := b.NewCursor()
+	ok := c.seek(after)
+	if ok && after != "" && c.item.Key == after {
+		ok = c.next()
+	}
+
+	var expired []KeyValue
+	for n := 0; ok && n < expirySampleSize; n++ {
+		if c.item.expired(now) {
+			expired = append(expired, c.item)
+		}
+		after = c.item.Key
+		ok = c.next()
+	}
+	if err := c.Err(); err != nil {
+		return "", 0, err
+	}
+	if !ok {
+		after = ""
+	}
+
+	var lsn uint64
+	for _, kv := range expired {
+		var err error
+		if lsn, err = b.removeExpired(kv); err != nil {
+			return after, lsn, err
+		}
+	}
+	return after, lsn, nil
+}
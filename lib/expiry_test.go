@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestExpiry checks that expired keys read as absent, are deleted by reads and
+// by the sweep with logged deletions, and that expiry times survive replay.
+func TestExpiry(t *testing.T) {
+	const (
+		ttl      = 100 * time.Millisecond
+		expiring = 2 * expirySampleSize
+	)
+	dir := t.TempDir()
+	b := openTestTree(t, dir, 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	if err := b.InsertWithTTL("zero", []byte("value"), 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("zero TTL returned %v, expected ErrInvalidTTL", err)
+	}
+	if err := b.Expire("missing", time.Hour); err == nil {
+		t.Fatal("expiry time was set on a missing key")
+	}
+	if err := b.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"kept", "persisted"} {
+		if err := b.Insert(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.InsertWithTTL("long", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Expire("persisted", ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Persist("persisted"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < expiring; i++ {
+		if err := b.InsertWithTTL(fmt.Sprintf("key-%04d", i), []byte("value"), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := fmt.Sprintf("key-%04d", expiring-1)
+	if got, err := b.TTL(last); err != nil || got <= 0 || got > ttl {
+		t.Fatalf("TTL of %s is %v, %v, expected up to %v", last, got, err, ttl)
+	}
+	end := time.Now()
+
+	checkTTLs := func(b *BTree) {
+		t.Helper()
+		for key, want := range map[string]time.Duration{"kept": NoExpiry, "persisted": NoExpiry, "long": time.Hour} {
+			got, err := b.TTL(key)
+			if err != nil || got > want || (want > 0 && got <= want-time.Minute) {
+				t.Fatalf("TTL of %s is %v, %v, expected %v", key, got, err, want)
+			}
+		}
+	}
+	checkTTLs(b)
+
+	time.Sleep(time.Until(end.Add(ttl)))
+	if _, err := b.Read("key-0000"); err == nil {
+		t.Fatal("expired key was read")
+	}
+	if _, err := b.TTL("key-0001"); err == nil {
+		t.Fatal("expired key has a TTL")
+	}
+	// The read deleted the key, TTL did not
+	if count := checkInvariants(t, b); count != expiring+2 {
+		t.Fatalf("tree holds %d keys after the read, expected %d", count, expiring+2)
+	}
+
+	// Sweep the whole tree, one sample at a time
+	b.mu.Lock()
+	after, batches := "", 0
+	var lsn uint64
+	for {
+		var err error
+		var batchLSN uint64
+		after, batchLSN, err = b.expireBatch(after, time.Now())
+		lsn = max(lsn, batchLSN)
+		if err != nil {
+			b.mu.Unlock()
+			t.Fatal(err)
+		}
+		batches++
+		if after == "" {
+			break
+		}
+	}
+	b.mu.Unlock()
+	if err := b.waitDurable(lsn); err != nil {
+		t.Fatal(err)
+	}
+	if batches < 2 {
+		t.Fatalf("sweep took %d batches, expected more than one", batches)
+	}
+	if count := checkInvariants(t, b); count != 3 {
+		t.Fatalf("tree holds %d keys after the sweep, expected 3", count)
+	}
+
+	// The deletion by the read is logged as well
+	deletes := 0
+	for _, entry := range readLog(t, dir) {
+		if entry.Operation == "DELETE" {
+			deletes++
+		}
+	}
+	if deletes != expiring {
+		t.Fatalf("log holds %d deletions, expected %d", deletes, expiring)
+	}
+
+	crashed := openTestTree(t, copyDatabase(t, dir), 10, KeyModeHMAC)
+	defer closeTestTree(t, crashed)
+	if count := checkInvariants(t, crashed); count != 3 {
+		t.Fatalf("replayed tree holds %d keys, expected 3", count)
+	}
+	checkTTLs(crashed)
+}
+
+// TestExpiryLoop checks that the background sweep deletes expired keys.
+func TestExpiryLoop(t *testing.T) {
+	opts := Options{ExpiryInterval: 5 * time.Millisecond, Durability: DurabilityNone}
+	b, err := NewBTreeWithOptions(3, t.TempDir(), "", "", StaticKeys(testHMACKey, testEncryptionKey, nil), 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestTree(t, b)
+
+	for i := 0; i < 20; i++ {
+		if err := b.InsertWithTTL(fmt.Sprintf("key-%04d", i), []byte("value"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Insert("kept", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); checkInvariants(t, b) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expired keys were not swept")
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Both files of a database start with a header recording the format version
+// and the settings the database was created with. In the database file it is
+// part of the header page, see pager. The log file starts with a fixed-size
+// header, all integers big endian:
+//
+//	offset  size  field
+//	0       8     magic, "KAYVLOG" followed by a zero byte
+//	8       2     format version
+//	10      1     key mode
+//	11      1     cipher suite
+//	12      4     tree order t
+//	16      8     creation time of the database, Unix nanoseconds
+//	24      4     reserved
+//	28      4     CRC-32C (Castagnoli) of the preceding bytes
+//
+// The log records follow the header, see logRecordHeaderSize. The creation
+// time ties a log to its database, so a log left over from another database
+// is never replayed into this one.
+//
+// NewBTree refuses files in another format version than the current one.
+// Files written by v1.2.4 and earlier predate format versions: both are plain
+// encoding/gob streams, which Migrate imports, see importGobDatabase.
+const (
+	dbFormatVersion  uint16 = 1
+	logFormatVersion uint16 = 1
+	logHeaderSize           = 32
+)
+
+// logMagic identifies a kayveedb log file.
+var logMagic = [8]byte{'K', 'A', 'Y', 'V', 'L', 'O', 'G', 0}
+
+// ErrUnsupportedFormat is returned for files in a format version other than
+// the current one, such as files written by a newer version of the package.
+var ErrUnsupportedFormat = errors.New("unsupported file format version")
+
+// ErrNeedsMigration is returned when the files of a database were written by
+// v1.2.4 or earlier. Migrate imports them.
+var ErrNeedsMigration = errors.New("database is in an older format and must be migrated")
+
+// ErrTreeOrderMismatch is returned when a database is opened with a tree
+// order other than the one it was created with.
+var ErrTreeOrderMismatch = errors.New("tree order does not match the database")
+
+// ErrLogMismatch is returned when the log file does not belong to the
+// database file.
+var ErrLogMismatch = errors.New("log file does not belong to the database")
+
+// fileHeader holds the settings recorded at the start of both database files.
+type fileHeader struct {
+	version uint16      // Format version the file was written in
+	t       int         // Minimum degree of the tree
+	keyMode KeyMode     // How keys are stored, see KeyMode
+	suite   CipherSuite // How values are sealed, see CipherSuite
+	created time.Time   // When the database was created or migrated
+}
+
+// encodeLogHeader returns the header of a log file belonging to a database
+// with the given header.
+func encodeLogHeader(header fileHeader) []byte {
+	buf := make([]byte, logHeaderSize)
+	copy(buf[0:8], logMagic[:])
+	binary.BigEndian.PutUint16(buf[8:10], logFormatVersion)
+	buf[10] = byte(header.keyMode)
+	buf[11] = byte(header.suite)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(header.t))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(header.created.UnixNano()))
+	binary.BigEndian.PutUint32(buf[28:32], crc32.Checksum(buf[:28], crcTable))
+	return buf
+}
+
+// readLogHeader reads the header at the start of a log file.
+func readLogHeader(r io.Reader) (fileHeader, error) {
+	buf := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return fileHeader{}, fmt.Errorf("%w: torn log header", ErrCorruptLogRecord)
+		}
+		return fileHeader{}, err
+	}
+	if !bytes.Equal(buf[0:8], logMagic[:]) {
+		return fileHeader{}, fmt.Errorf("%w: not a kayveedb log file", ErrCorruptLogRecord)
+	}
+	if crc32.Checksum(buf[:28], crcTable) != binary.BigEndian.Uint32(buf[28:32]) {
+		return fileHeader{}, fmt.Errorf("%w: log header", ErrCorruptLogRecord)
+	}
+
+	header := fileHeader{
+		version: binary.BigEndian.Uint16(buf[8:10]),
+		keyMode: KeyMode(buf[10]),
+		suite:   CipherSuite(buf[11]),
+		t:       int(binary.BigEndian.Uint32(buf[12:16])),
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(buf[16:24]))),
+	}
+	return header, nil
+}
+
+// checkVersion returns an error unless a file of the given kind is in the
+// current format version.
+func checkVersion(kind string, version, current uint16) error {
+	if version != current {
+		return fmt.Errorf("%w: %s file version %d", ErrUnsupportedFormat, kind, version)
+	}
+	return nil
+}
+
+// checkLog returns an error unless a log header is in the current format and
+// was written for the database with header h.
+func (h fileHeader) checkLog(log fileHeader) error {
+	if err := checkVersion("log", log.version, logFormatVersion); err != nil {
+		return err
+	}
+	if log.keyMode != h.keyMode || log.suite != h.suite || log.t != h.t || !log.created.Equal(h.created) {
+		return fmt.Errorf("%w: log was created with the database of %s", ErrLogMismatch, log.created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// initLog writes the header of an empty log file.
+func (b *BTree) initLog() error {
+	if _, err := b.logFile.Write(encodeLogHeader(b.pager.header)); err != nil {
+		return fmt.Errorf("failed to write log header: %w", err)
+	}
+	if err := b.logFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log: %w", err)
+	}
+	b.logSize = logHeaderSize
+	return nil
+}
+
+// Migrate imports a database written by v1.2.4 or earlier, whose files are
+// plain encoding/gob streams, into the current format in place, see
+// importGobDatabase. Those versions did not record the tree order, so t must
+// be the order the database has always been opened with; the creation time is
+// set to the time of the import. Files in any other format are left
+// untouched, so Migrate can be run again after it was interrupted. The
+// database must not be open while it runs.
+//
+// The imported database uses the HMAC key mode and XChaCha20-Poly1305. The
+// first NewBTree after the import seals its values again in the current
+// format, and needs the shared nonce they were sealed under as KeySet.Nonce.
+func Migrate(dbPath, dbName, logName string, t int) error {
+	if t < 2 {
+		return fmt.Errorf("invalid tree order %d", t)
+	}
+	if dbName == "" {
+		dbName = "kayvee.db"
+	}
+	if logName == "" {
+		logName = "kayvee.log"
+	}
+
+	dbFilePath := filepath.Join(dbPath, dbName)
+	logFilePath := filepath.Join(dbPath, logName)
+	legacy, err := isGobDatabase(dbFilePath, logFilePath)
+	if err != nil || !legacy {
+		return err
+	}
+	return importGobDatabase(dbFilePath, logFilePath, t)
+}
+
+// createDB creates an empty database file with the given header next to path
+// and renames it over path. It returns the header of the new file.
+func createDB(path string, header fileHeader) (fileHeader, error) {
+	tmpPath := path + ".migrate"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return header, fmt.Errorf("failed to create migrated database: %w", err)
+	}
+	defer file.Close()
+
+	p, err := newPager(file, header)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return header, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	syncDir(filepath.Dir(path))
+	return p.header, nil
+}
+
+// rewriteLog writes a log in the current format with the given header and the
+// entries next returns until io.EOF next to path, and renames it over path, so
+// a crash leaves either the old or the new log in place.
+func rewriteLog(path string, header fileHeader, next func() (LogEntry, error)) error {
+	tmpPath := path + ".migrate"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create migrated log: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	_, err = w.Write(encodeLogHeader(header))
+	for err == nil {
+		var entry LogEntry
+		if entry, err = next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		var record []byte
+		if record, err = encodeLogRecord(entry); err == nil {
+			_, err = w.Write(record)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to migrate log: %w", err)
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Databases written by v1.2.4 and earlier encoded their nodes and log entries
+// with encoding/gob. Node has no exported fields, so gob never stored a node
+// and the database file holds no tree; every key lives in the log, a gob
+// stream of LogEntry values holding the operation, the original key and, for
+// CREATE and UPDATE, the value sealed with XChaCha20-Poly1305 under the
+// shared nonce and no additional data.
+
+// gobLogRecord is a log entry as v1.2.4 and earlier encoded it.
+type gobLogRecord struct {
+	Operation string
+	Key       string
+	Value     []byte
+}
+
+// gobLogOperations are the operations logged by v1.2.4 and earlier.
+var gobLogOperations = map[string]bool{"CREATE": true, "UPDATE": true, "DELETE": true}
+
+// isGobDatabase reports whether the database or log file was written by
+// v1.2.4 or earlier.
+func isGobDatabase(dbFilePath, logFilePath string) (bool, error) {
+	legacy, err := isGobFile(dbFilePath, false)
+	if err != nil || legacy {
+		return legacy, err
+	}
+	return isGobFile(logFilePath, true)
+}
+
+// isGobFile reports whether the database file at path, or the log file if log
+// is set, was written by v1.2.4 or earlier. A missing file was not.
+func isGobFile(path string, log bool) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	start, err := reader.Peek(pageHeaderSize + len(dbMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch {
+	case len(start) == 0, bytes.HasPrefix(start, logMagic[:]):
+		return false, nil
+	case len(start) == pageHeaderSize+len(dbMagic) && bytes.Equal(start[pageHeaderSize:], dbMagic[:]):
+		return false, nil
+	case log:
+		var record gobLogRecord
+		return gob.NewDecoder(reader).Decode(&record) == nil && gobLogOperations[record.Operation], nil
+	}
+	// The database file started with the offset of the root node
+	var root int64
+	return gob.NewDecoder(reader).Decode(&root) == nil, nil
+}
+
+// importGobDatabase migrates a database written by v1.2.4 or earlier. The
+// database file is replaced by an empty one in the current format, and the
+// log by one holding the same operations as framed records, which NewBTree
+// replays into the tree like any other log. Values are logged as they were
+// stored, in IMPORT records, which replay seals again, see replayImport. A
+// log record torn at the tail is dropped; any other record that cannot be
+// read fails the import and leaves the log as it was.
+func importGobDatabase(dbFilePath, logFilePath string, t int) error {
+	if committedLSN(dbFilePath) != 0 {
+		return fmt.Errorf("%w: log was written by v1.2.4 but the database holds a tree", ErrLogMismatch)
+	}
+
+	header, err := createDB(dbFilePath, fileHeader{t: t, keyMode: KeyModeHMAC, suite: CipherSuiteXChaCha20Poly1305, created: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	old, err := os.Open(logFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer old.Close()
+
+	// v1.2.4 created an encoder for every entry, so each record carries its
+	// own type definitions and needs a decoder of its own. The decoder reads
+	// no further than its record from a reader that is an io.ByteReader.
+	reader := bufio.NewReader(old)
+	lsn := uint64(0)
+	return rewriteLog(logFilePath, header, func() (LogEntry, error) {
+		var record gobLogRecord
+		if err := gob.NewDecoder(reader).Decode(&record); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// Torn at the tail
+				err = io.EOF
+			}
+			if err != io.EOF {
+				err = fmt.Errorf("%w: log record %d: %v", ErrCorruptLogRecord, lsn+1, err)
+			}
+			return LogEntry{}, err
+		}
+		if !gobLogOperations[record.Operation] {
+			return LogEntry{}, fmt.Errorf("%w: log record %d has unknown operation %q", ErrCorruptLogRecord, lsn+1, record.Operation)
+		}
+		lsn++
+		entry := LogEntry{LSN: lsn, Timestamp: header.created, Operation: "DELETE", Key: record.Key}
+		if record.Operation != "DELETE" {
+			entry.Operation = "IMPORT"
+			entry.Value = record.Value
+		}
+		return entry, nil
+	})
+}
+
+// committedLSN returns the checkpoint LSN of the database file at path, or
+// zero if it is not a readable database in the page format. A database file
+// left behind by an interrupted import, or created by a NewBTree that then
+// refused the gob log, never had a log record committed to it.
+func committedLSN(path string) uint64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err != nil || info.Size() == 0 {
+		return 0
+	}
+	if legacy, _ := isGobFile(path, false); legacy {
+		return 0
+	}
+	p, err := newPager(file, fileHeader{})
+	if err != nil {
+		return 0
+	}
+	return p.meta.lsn
+}
+
+// syncDir makes a rename in dir durable. It is a best effort, as not every
+// file system supports syncing a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// gobLogEntry is a log entry as v1.2.4 encoded it.
+type gobLogEntry struct {
+	Operation string
+	Key       string
+	Value     []byte
+}
+
+// writeGobDatabase writes the files of a database as v1.2.4 left them after
+// the given operations, with the values sealed under nonce: a database file
+// holding only the gob encoded root offset and a gob log, torn at the tail.
+// It returns the log.
+func writeGobDatabase(t *testing.T, dir string, nonce []byte, ops []gobLogEntry) []byte {
+	t.Helper()
+	aead, err := chacha20poly1305.NewX(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var db bytes.Buffer
+	if err := gob.NewEncoder(&db).Encode(int64(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kayvee.db"), db.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// v1.2.4 created an encoder for every entry
+	var log bytes.Buffer
+	for _, op := range ops {
+		if op.Value != nil {
+			op.Value = aead.Seal(nil, nonce, op.Value, nil)
+		}
+		if err := gob.NewEncoder(&log).Encode(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Write([]byte{0x20, 0xff, 0x81})
+	if err := os.WriteFile(filepath.Join(dir, "kayvee.log"), log.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return log.Bytes()
+}
+
+// TestMigrateGobDatabase checks that Migrate imports the files of a v1.2.4
+// database, which NewBTree refuses without changing them. v1.2.4 failed to
+// write its root node, so its database file is usually empty.
+func TestMigrateGobDatabase(t *testing.T) {
+	t.Run("root offset", func(t *testing.T) { testMigrateGobDatabase(t, false) })
+	t.Run("empty", func(t *testing.T) { testMigrateGobDatabase(t, true) })
+}
+
+func testMigrateGobDatabase(t *testing.T, emptyDB bool) {
+	dir := t.TempDir()
+	nonce := bytes.Repeat([]byte{0x33}, chacha20poly1305.NonceSizeX)
+	keys := StaticKeys(testHMACKey, testEncryptionKey, nonce)
+	writeGobDatabase(t, dir, nonce, []gobLogEntry{
+		{Operation: "CREATE", Key: "alpha", Value: []byte("one")},
+		{Operation: "CREATE", Key: "beta", Value: []byte("two")},
+		{Operation: "CREATE", Key: "gamma", Value: []byte("three")},
+		{Operation: "UPDATE", Key: "beta", Value: []byte("two again")},
+		{Operation: "DELETE", Key: "gamma"},
+		{Operation: "DELETE", Key: "missing"},
+		{Operation: "CREATE", Key: "delta", Value: []byte("four")},
+	})
+	if emptyDB {
+		if err := os.Truncate(filepath.Join(dir, "kayvee.db"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logPath := filepath.Join(dir, "kayvee.log")
+	before, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewBTree(3, dir, "", "", keys, 10); !errors.Is(err, ErrNeedsMigration) {
+		t.Fatalf("expected ErrNeedsMigration, got %v", err)
+	}
+	if after, err := os.ReadFile(logPath); err != nil || !bytes.Equal(after, before) {
+		t.Fatalf("refused open changed the log: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := Migrate(dir, "", "", 3); err != nil {
+			t.Fatalf("migration %d failed: %v", i+1, err)
+		}
+	}
+	withoutNonce := StaticKeys(testHMACKey, testEncryptionKey, nil)
+	if _, err := NewBTree(3, dir, "", "", withoutNonce, 10); err == nil {
+		t.Fatal("imported values were replayed without the shared nonce")
+	}
+	b, err := NewBTree(3, dir, "", "", keys, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"alpha": "one", "beta": "two again", "delta": "four"}
+	for _, key := range []string{"alpha", "beta", "gamma", "delta"} {
+		value, err := b.Read(key)
+		switch expected, ok := want[key]; {
+		case !ok && err == nil:
+			t.Fatalf("deleted key %s was read", key)
+		case ok && (err != nil || string(value) != expected):
+			t.Fatalf("read %s: %q, %v", key, value, err)
+		}
+	}
+	names, err := b.ListKeyNames()
+	slices.Sort(names)
+	if err != nil || !slices.Equal(names, []string{"alpha", "beta", "delta"}) {
+		t.Fatalf("listed %v, %v", names, err)
+	}
+	closeTestTree(t, b)
+
+	// The import was replayed and checkpointed with the values sealed again,
+	// so the shared nonce is no longer needed
+	b, err = NewBTree(3, dir, "", "", withoutNonce, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.Read("beta"); err != nil || string(value) != "two again" {
+		t.Fatalf("read beta after reopening: %q, %v", value, err)
+	}
+	closeTestTree(t, b)
+}
+
+// TestMigrateDamagedGobLog checks that Migrate refuses a v1.2.4 log with a
+// damaged record before its tail instead of dropping the records after it.
+func TestMigrateDamagedGobLog(t *testing.T) {
+	dir := t.TempDir()
+	nonce := bytes.Repeat([]byte{0x33}, chacha20poly1305.NonceSizeX)
+	log := writeGobDatabase(t, dir, nonce, []gobLogEntry{
+		{Operation: "CREATE", Key: "alpha", Value: []byte("one")},
+		{Operation: "CREATE", Key: "beta", Value: []byte("two")},
+		{Operation: "CREATE", Key: "gamma", Value: []byte("three")},
+	})
+	// Overwrite the operation of the second record, whose name is the second
+	// "CREATE" in the log
+	first := bytes.Index(log, []byte("CREATE"))
+	second := first + 1 + bytes.Index(log[first+1:], []byte("CREATE"))
+	copy(log[second:], "DROPIT")
+	logPath := filepath.Join(dir, "kayvee.log")
+	if err := os.WriteFile(logPath, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(dir, "", "", 3); !errors.Is(err, ErrCorruptLogRecord) {
+		t.Fatalf("expected ErrCorruptLogRecord, got %v", err)
+	}
+	if after, err := os.ReadFile(logPath); err != nil || !bytes.Equal(after, log) {
+		t.Fatalf("failed migration changed the log: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// logWriter appends records to the operation log with group commit.
+//
+// Records are queued while the tree lock is held, which fixes their order, and
+// made durable after it is released. The first writer to wait for its record
+// becomes the leader: it takes every queued record, writes them with a single
+// write and a single fsync, and wakes the writers whose records were covered.
+// Writers that queue records in the meantime wait for the next round, so under
+// concurrent load many operations share one fsync. Outside DurabilityAlways the
+// leader only writes the batch, and syncing is left to the sync loop or the OS.
+type logWriter struct {
+	file    *os.File
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte // Records queued for the next write
+	queued  uint64 // LSN of the last queued record
+	written uint64 // LSN of the last record written to the file
+	synced  uint64 // LSN of the last durable record
+	syncing bool   // Set while a leader writes a batch
+	err     error  // First write or sync error; the log is unusable after it
+
+	mode          Durability    // When written records are synced
+	interval      time.Duration // Sync interval in DurabilityInterval
+	stop          chan struct{} // Closed to stop the sync loop, nil when it is not running
+	writtenBytes  int64         // Bytes written since the writer was created
+	syncedBytes   int64         // Bytes of writtenBytes known to be durable
+	unsyncedSince time.Time     // When the oldest unsynced record was written, zero if none
+	lastSync      time.Time     // When the log was last synced
+	syncs         uint64        // Syncs of the log since the writer was created
+}
+
+// newLogWriter returns a log writer appending to file.
+func newLogWriter(file *os.File) *logWriter {
+	w := &logWriter{file: file}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// append queues a framed record with the given LSN.
+func (w *logWriter) append(record []byte, lsn uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, record...)
+	w.queued = lsn
+}
+
+// acknowledged returns the LSN up to which waiting writers are released:
+// the durable records in DurabilityAlways and the written ones otherwise.
+func (w *logWriter) acknowledged() uint64 {
+	if w.mode == DurabilityAlways {
+		return w.synced
+	}
+	return w.written
+}
+
+// wait blocks until the record with the given LSN, and every record before
+// it, is acknowledged under the current durability mode. An LSN of 0 returns
+// immediately.
+func (w *logWriter) wait(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.acknowledged() < lsn {
+		if w.err != nil {
+			return w.err
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		// Lead the next round with everything queued so far
+		w.syncing = true
+		buf, last, sync := w.buf, w.queued, w.mode == DurabilityAlways
+		w.buf = nil
+		w.mu.Unlock()
+		err := w.write(buf, sync)
+		w.mu.Lock()
+
+		w.syncing = false
+		if err != nil {
+			w.err = err
+		} else {
+			w.written = last
+			w.writtenBytes += int64(len(buf))
+			if sync {
+				w.syncs++
+				w.markSynced(w.written, w.writtenBytes)
+			} else if w.unsyncedSince.IsZero() && len(buf) > 0 {
+				w.unsyncedSince = time.Now()
+			}
+		}
+		w.cond.Broadcast()
+	}
+	return nil
+}
+
+// flush writes every queued record to the file, syncing it in DurabilityAlways.
+func (w *logWriter) flush() error {
+	w.mu.Lock()
+	lsn := w.queued
+	w.mu.Unlock()
+	return w.wait(lsn)
+}
+
+// write appends a batch of records to the log file, and syncs it if asked to.
+func (w *logWriter) write(buf []byte, sync bool) error {
+	if _, err := w.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write log: %w", err)
+	}
+	if !sync {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log: %w", err)
+	}
+	return nil
+}
+
+// sync makes every record written so far durable.
+func (w *logWriter) sync() error {
+	w.mu.Lock()
+	lsn, bytes := w.written, w.writtenBytes
+	if w.err != nil || w.syncedBytes >= bytes {
+		w.mu.Unlock()
+		return w.err
+	}
+	w.mu.Unlock()
+
+	err := w.file.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if w.err == nil {
+			w.err = fmt.Errorf("failed to sync log: %w", err)
+		}
+		w.cond.Broadcast()
+		return w.err
+	}
+	w.syncs++
+	w.markSynced(lsn, bytes)
+	return nil
+}
+
+// markSynced records that the log is durable up to the given LSN and byte count.
+func (w *logWriter) markSynced(lsn uint64, bytes int64) {
+	w.synced = max(w.synced, lsn)
+	w.syncedBytes = max(w.syncedBytes, bytes)
+	w.lastSync = time.Now()
+	if w.syncedBytes >= w.writtenBytes {
+		w.unsyncedSince = time.Time{}
+	} else {
+		// Records written while the sync ran are not covered by it
+		w.unsyncedSince = w.lastSync
+	}
+}
+
+// checkpointed records that every record up to lsn is part of the committed
+// tree, and so no longer depends on the log being synced.
+func (w *logWriter) checkpointed(lsn uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.markSynced(lsn, w.writtenBytes)
+}
+
+// waitDurable waits for the log record of a completed operation. If the log
+// cannot be written, operations applied to the tree are no longer backed by
+// it, so the tree is rolled back and refuses further use.
+func (b *BTree) waitDurable(lsn uint64) error {
+	err := b.wal.wait(lsn)
+	if err == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failed == nil {
+		b.failed = fmt.Errorf("%w: %v", ErrNeedsRecovery, err)
+		b.abort(err)
+	}
+	return err
+}
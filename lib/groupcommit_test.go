@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestGroupCommit checks that writers waiting on a round in progress share
+// the next write and sync of the log.
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{ExpiryInterval: -1, Durability: DurabilityAlways}
+	b, err := NewBTreeWithOptions(3, dir, "", "", StaticKeys(testHMACKey, testEncryptionKey, nil), 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Insert("first", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	before := b.DurabilityStats()
+
+	// Hold the log as if a leader were writing a round, so every writer
+	// queues its record and waits
+	b.wal.mu.Lock()
+	b.wal.syncing = true
+	b.wal.mu.Unlock()
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := b.Insert(fmt.Sprint("key-", i), []byte("value")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	for deadline := time.Now().Add(5 * time.Second); b.DurabilityStats().LastLSN < before.LastLSN+writers; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("writers did not queue their records")
+		}
+	}
+	if stats := b.DurabilityStats(); stats.SyncedLSN != before.SyncedLSN || stats.UnsyncedRecords != writers {
+		t.Fatalf("records were synced before the round: %+v", stats)
+	}
+
+	b.wal.mu.Lock()
+	b.wal.syncing = false
+	b.wal.cond.Broadcast()
+	b.wal.mu.Unlock()
+	wg.Wait()
+
+	stats := b.DurabilityStats()
+	if stats.Syncs != before.Syncs+1 {
+		t.Fatalf("%d writers took %d syncs, expected one", writers, stats.Syncs-before.Syncs)
+	}
+	if stats.SyncedLSN != stats.LastLSN || stats.UnsyncedRecords != 0 || stats.UnsyncedBytes != 0 {
+		t.Fatalf("log is not durable after the round: %+v", stats)
+	}
+
+	crashed := openTestTree(t, copyDatabase(t, dir), 10, KeyModeHMAC)
+	for i := 0; i < writers; i++ {
+		if _, err := crashed.Read(fmt.Sprint("key-", i)); err != nil {
+			t.Fatalf("key-%d was lost: %v", i, err)
+		}
+	}
+	closeTestTree(t, crashed)
+	closeTestTree(t, b)
+}
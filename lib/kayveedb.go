@@ -1,17 +1,25 @@
 package lib
 
 import (
+	"bufio"
 	"container/list"
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -36,29 +44,85 @@ type Cache struct {
 }
 
 type LogEntry struct {
+	LSN       uint64    // Log sequence number, increasing by one per record
+	Timestamp time.Time // When the operation was logged
 	Operation string
 	Key       string
 	Value     []byte
+	Ops       []LogEntry // Operations of a BATCH entry, applied together
+
+	IndexKey     string // Index key the value is sealed for, when it differs from Key
+	EncryptedKey []byte // Encrypted key name stored with the value, if any
+	ExpiresAt    int64  // Expiry time stored with the value, see KeyValue
 }
 
 type KeyValue struct {
-	Key   string
-	Value []byte
+	Key          string
+	Value        []byte
+	EncryptedKey []byte // Original key, encrypted; nil when keys are stored in plaintext
+	ExpiresAt    int64  // When the key expires, in Unix nanoseconds; zero if it never does
+	Version      uint64 // LSN of the operation that last wrote the key, see CompareAndSwap
 }
 
 // BTree structure with a node cache and client manager
 type BTree struct {
-	root    *Node
-	t       int
-	dbPath  string
-	dbName  string
-	logName string
-	dbFile  *os.File
-	logFile *os.File
-	hmacKey []byte
-	mu      sync.RWMutex
-	cache   *Cache // Cache with configurable size
-	clients *ClientManager // ClientManager for tracking active clients
+	root        *Node
+	t           int
+	dbPath      string
+	dbName      string
+	logName     string
+	dbFile      *os.File
+	logFile     *os.File
+	pager       *pager     // Page allocator for dbFile
+	wal         *logWriter // Group commit writer for logFile
+	hmacKey     []byte
+	keyMode     KeyMode     // How keys are stored in the tree
+	cipherSuite CipherSuite // How values are sealed
+
+	encryptionKey []byte // Key values are sealed with, see valueKeys during a rotation
+	legacyNonce   []byte // Shared nonce of values imported from v1.2.4, see replayImport; nil if none
+	mu            sync.RWMutex
+	cache         *Cache         // Cache with configurable size
+	clients       *ClientManager // ClientManager for tracking active clients
+
+	// relocated maps the offset of a committed node to the offset of its
+	// copy-on-write replacement until the next commit
+	relocated  map[int64]int64
+	modCount   uint64        // Incremented on every change to the tree, checked by cursors
+	compacting chan struct{} // Closed when the running compaction finishes, nil if none
+	closed     bool          // Set by Close
+
+	lsn               uint64        // LSN of the last record written to or replayed from the log
+	logSize           int64         // Bytes in the log file
+	checkpointLogSize int64         // Log size that triggers a checkpoint, 0 to disable
+	recovery          RecoveryInfo  // Outcome of the log replay when the tree was opened
+	failed            error         // Set when an operation could not be undone, see abort
+	stop              chan struct{} // Closed by Close to stop the checkpoint loop and the expiry sweep
+
+	rotation     atomic.Pointer[keyRotation]  // Current or last key rotation, nil if none
+	hmacRotation atomic.Pointer[hmacRotation] // Current or last HMAC key rotation, nil if none
+}
+
+// Options holds the optional settings for NewBTreeWithOptions.
+type Options struct {
+	KeyMode     KeyMode     // How keys are stored, see KeyMode
+	CipherSuite CipherSuite // How values are sealed, see CipherSuite
+
+	// CheckpointLogSize is the log size in bytes that triggers a checkpoint
+	// after a write. Zero selects DefaultCheckpointLogSize and a negative
+	// value disables size-based checkpoints.
+	CheckpointLogSize int64
+	// CheckpointInterval runs a checkpoint in the background at this
+	// interval. Zero disables timed checkpoints.
+	CheckpointInterval time.Duration
+
+	Durability   Durability    // When the log is synced, see Durability
+	SyncInterval time.Duration // Sync interval for DurabilityInterval, zero for DefaultSyncInterval
+
+	// ExpiryInterval is how often the background sweep looks for expired
+	// keys. Zero selects DefaultExpiryInterval and a negative value disables
+	// the sweep, leaving expired keys in place until they are read.
+	ExpiryInterval time.Duration
 }
 
 // Add trailing slash to dbPath if not present
@@ -76,6 +140,7 @@ type Node struct {
 	isLeaf   bool
 	numKeys  int
 	offset   int64
+	pages    []uint64 // Page chain holding the encoded node, first page at offset
 }
 
 // NewCache creates a new LRU cache with a given size
@@ -107,19 +172,25 @@ func (b *BTree) RemoveClient(clientID uint32) error {
 	return nil
 }
 
-// Shutdown gracefully shuts down the BTree.
+// Shutdown gracefully shuts down the BTree, see Close.
+// The key material held by the tree is zeroed, so it cannot be used afterwards.
 func (bt *BTree) Shutdown() error {
-	bt.mu.Lock()
-	defer bt.mu.Unlock()
-	// Perform necessary cleanup...
+	if err := bt.Close(context.Background()); err != nil {
+		return err
+	}
 	fmt.Println("BTree shutdown successfully.")
 	return nil
 }
-// ListKeys lists all keys in the BTree in sorted order.
+
+// ListKeys lists all keys in the BTree in sorted order, leaving out expired keys.
 func (bt *BTree) ListKeys() ([]string, error) {
 	bt.mu.RLock() // Use the correct mutex field
 	defer bt.mu.RUnlock()
 
+	if bt.closed {
+		return nil, ErrClosed
+	}
+
 	// Ensure the tree is not nil.
 	if bt.root == nil {
 		return nil, fmt.Errorf("BTree is empty")
@@ -127,6 +198,7 @@ func (bt *BTree) ListKeys() ([]string, error) {
 
 	// Store all keys found during traversal.
 	var keys []string
+	now := time.Now()
 
 	// Helper function to traverse the tree in-order.
 	var traverse func(node *Node)
@@ -145,8 +217,10 @@ func (bt *BTree) ListKeys() ([]string, error) {
 				}
 			}
 
-			// Visit the key itself.
-			keys = append(keys, node.keys[i].Key)
+			// Visit the key itself, unless it has expired.
+			if !node.keys[i].expired(now) {
+				keys = append(keys, node.keys[i].Key)
+			}
 
 			// Traverse the rightmost child.
 			if i == node.numKeys-1 && i+1 < len(node.children) {
@@ -164,6 +238,59 @@ func (bt *BTree) ListKeys() ([]string, error) {
 	return keys, nil
 }
 
+// ListKeyNames lists the original keys stored in the BTree, in tree order.
+func (bt *BTree) ListKeyNames() ([]string, error) {
+	return bt.Keys("*")
+}
+
+// Keys lists the original keys matching a glob pattern, using the syntax of path.Match.
+// When keys are stored in order, only the range sharing the pattern's literal prefix is scanned.
+func (bt *BTree) Keys(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if bt.keyMode == KeyModePlain {
+		if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+			prefix = pattern[:i]
+		} else {
+			prefix = pattern
+		}
+	}
+
+	var keys []string
+	it := bt.Prefix(prefix, 0, false)
+	for it.Next() {
+		name, err := bt.KeyName(it.Item())
+		if err != nil {
+			return nil, err
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			keys = append(keys, name)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeyName returns the original key of a key-value pair returned by a Cursor or Iterator.
+func (bt *BTree) KeyName(kv KeyValue) (string, error) {
+	if bt.keyMode == KeyModePlain {
+		return kv.Key, nil
+	}
+	if kv.EncryptedKey == nil {
+		return "", errors.New("key name was not recorded")
+	}
+	name, err := bt.decrypt(kv.EncryptedKey, bt.nameKeys(), kv.Key)
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
 
 // Get retrieves a node from the cache and moves it to the front (most recently used)
 func (c *Cache) Get(offset int64) (*Node, bool) {
@@ -187,17 +314,22 @@ func (c *Cache) Put(offset int64, node *Node, dirty bool) {
 	if entry, ok := c.store.Load(offset); ok {
 		cacheEntry := entry.(*CacheEntry)
 		// Update the node and move it to the front of the list
+		c.mu.Lock()
 		cacheEntry.node = node
 		cacheEntry.dirty = dirty
-		c.mu.Lock()
 		c.order.MoveToFront(cacheEntry.element)
 		c.mu.Unlock()
 		return
 	}
 
-	// If the cache is full, evict the least recently used node (the tail of the list)
-	if c.size > 0 && c.order.Len() >= c.size {
-		c.evict()
+	// If the cache is full, evict the least recently used node (the tail of the list).
+	// Clean nodes are only put by readNode, which may run under the read lock
+	// alongside other readers, so only writers flush dirty nodes to make room.
+	c.mu.Lock()
+	full := c.size > 0 && c.order.Len() >= c.size
+	c.mu.Unlock()
+	if full {
+		c.evict(dirty)
 	}
 
 	// Add the new node to the front of the list (most recently used)
@@ -213,26 +345,27 @@ func (c *Cache) Put(offset int64, node *Node, dirty bool) {
 	c.store.Store(offset, cacheEntry)
 }
 
-// evict removes the least recently used node from the cache
-func (c *Cache) evict() {
+// evict removes the least recently used node from the cache, or the least
+// recently used clean node unless flush is set
+func (c *Cache) evict(flush bool) {
 	// Get the least recently used node (the tail of the list)
 	c.mu.Lock()
-	tail := c.order.Back()
+	var tail *list.Element
+	var cacheEntry *CacheEntry
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		entry, ok := c.store.Load(e.Value.(int64))
+		if ok && (flush || !entry.(*CacheEntry).dirty) {
+			tail, cacheEntry = e, entry.(*CacheEntry)
+			break
+		}
+	}
 	c.mu.Unlock()
 
 	if tail == nil {
 		return
 	}
-
 	offset := tail.Value.(int64)
 
-	// Load the cache entry for the node to be evicted
-	entry, ok := c.store.Load(offset)
-	if !ok {
-		return
-	}
-	cacheEntry := entry.(*CacheEntry)
-
 	// Flush the dirty node to disk before eviction
 	if cacheEntry.dirty {
 		if err := c.flushFn(offset, cacheEntry.node); err != nil {
@@ -247,8 +380,72 @@ func (c *Cache) evict() {
 	c.store.Delete(offset)
 }
 
-// NewBTree initializes the B-tree and adds a cache with configurable size
-func NewBTree(t int, dbPath, dbName, logName string, hmacKey, encryptionKey, nonce []byte, cacheSize int) (*BTree, error) {
+// Remove drops a node from the cache without flushing it, used when its pages are released
+func (c *Cache) Remove(offset int64) {
+	entry, ok := c.store.LoadAndDelete(offset)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	c.order.Remove(entry.(*CacheEntry).element)
+	c.mu.Unlock()
+}
+
+// Reset drops every node from the cache without flushing
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store.Range(func(key, value any) bool {
+		c.store.Delete(key)
+		return true
+	})
+	c.order.Init()
+}
+
+// Flush writes every dirty node to disk and marks it clean
+func (c *Cache) Flush() error {
+	var flushErr error
+	c.store.Range(func(key, value any) bool {
+		cacheEntry := value.(*CacheEntry)
+		if !cacheEntry.dirty {
+			return true
+		}
+		if err := c.flushFn(cacheEntry.offset, cacheEntry.node); err != nil {
+			flushErr = fmt.Errorf("failed to flush node at offset %d: %w", cacheEntry.offset, err)
+			return false
+		}
+		cacheEntry.dirty = false
+		return true
+	})
+	return flushErr
+}
+
+// NewBTree initializes the B-tree and adds a cache with configurable size.
+// keys supplies the key material, see KeySet. Values are encrypted under a
+// random nonce each; KeySet.Nonce is only used to read the values of a
+// database imported from v1.2.4 by Migrate, and may be nil otherwise.
+func NewBTree(t int, dbPath, dbName, logName string, keys KeyProvider, cacheSize int) (*BTree, error) {
+	return NewBTreeWithOptions(t, dbPath, dbName, logName, keys, cacheSize, Options{})
+}
+
+// NewBTreeWithOptions initializes the B-tree like NewBTree and applies the given options.
+// The tree order, key mode and cipher suite are recorded when the database is created;
+// opening an existing database with a different order fails with ErrTreeOrderMismatch,
+// with a different explicit key mode with ErrKeyModeMismatch, and with a different
+// explicit cipher suite with ErrCipherSuiteMismatch. Databases in an older format
+// fail with ErrNeedsMigration, see Migrate. An empty HMAC key is only accepted
+// for databases in KeyModePlain.
+// Log records written after the last checkpoint are replayed before it returns.
+func NewBTreeWithOptions(t int, dbPath, dbName, logName string, keys KeyProvider, cacheSize int, opts Options) (_ *BTree, err error) {
+	keySet, err := keys.LoadKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %w", err)
+	}
+	if len(keySet.EncryptionKey) != chacha20poly1305.KeySize {
+		keySet.Zero()
+		return nil, fmt.Errorf("encryption key must be %d bytes", chacha20poly1305.KeySize)
+	}
+
 	// Ensure the dbPath has a trailing slash
 	dbPath = ensureTrailingSlash(dbPath)
 
@@ -266,27 +463,6 @@ func NewBTree(t int, dbPath, dbName, logName string, hmacKey, encryptionKey, non
 	dbFilePath := filepath.Join(dbPath, dbName)
 	logFilePath := filepath.Join(dbPath, logName)
 
-	flushFn := func(offset int64, node *Node) error {
-		// Flush the node to disk before eviction
-		file, err := os.OpenFile(dbFilePath, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to open database file: %w", err)
-		}
-		defer file.Close()
-
-		// Seek to the node's offset
-		if _, err := file.Seek(offset, io.SeekStart); err != nil {
-			return fmt.Errorf("failed seeking node at offset %d: %w", offset, err)
-		}
-
-		// Encode and write the node to disk
-		encoder := gob.NewEncoder(file)
-		if err := encoder.Encode(node); err != nil {
-			return fmt.Errorf("failed to encode node at offset %d: %w", offset, err)
-		}
-		return nil
-	}
-
 	// Initialize the client manager
 	clientManager := NewClientManager()
 
@@ -295,99 +471,275 @@ func NewBTree(t int, dbPath, dbName, logName string, hmacKey, encryptionKey, non
 		dbPath:  dbPath,
 		dbName:  dbName,
 		logName: logName,
-		hmacKey: hmacKey,
-		cache:   NewCache(cacheSize, flushFn), // Initialize a cache with configurable size
-		clients: clientManager,                // Initialize ClientManager
+		hmacKey: keySet.HMACKey,
+		clients: clientManager, // Initialize ClientManager
+
+		relocated:     make(map[int64]int64),
+		encryptionKey: keySet.EncryptionKey,
+		legacyNonce:   keySet.Nonce,
+	}
+	b.cache = NewCache(cacheSize, b.flushNode) // Initialize a cache with configurable size
+
+	// A tree that is not returned must not keep its files open or its keys in memory
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, file := range []*os.File{b.dbFile, b.logFile} {
+			if file != nil {
+				file.Close()
+			}
+		}
+		keySet.Zero()
+	}()
+
+	// Files written by v1.2.4 and earlier are imported by Migrate
+	legacy, err := isGobDatabase(dbFilePath, logFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return nil, fmt.Errorf("%w: files were written by v1.2.4 or earlier", ErrNeedsMigration)
 	}
 
 	// Open database file
-	var err error
 	b.dbFile, err = os.OpenFile(dbFilePath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	keyMode := opts.KeyMode
+	if keyMode == KeyModeDefault {
+		keyMode = KeyModeHMAC
+	}
+	if !keyMode.supported() {
+		return nil, fmt.Errorf("unsupported key mode %s", keyMode)
+	}
+	suite := opts.CipherSuite
+	if suite == CipherSuiteDefault {
+		suite = CipherSuiteXChaCha20Poly1305
+	}
+	if _, ok := suites[suite]; !ok {
+		return nil, fmt.Errorf("unsupported cipher suite %s", suite)
+	}
+	b.pager, err = newPager(b.dbFile, fileHeader{t: t, keyMode: keyMode, suite: suite, created: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	header := b.pager.header
+	if err := checkVersion("database", header.version, dbFormatVersion); err != nil {
+		return nil, err
+	}
+	if header.t != t {
+		return nil, fmt.Errorf("%w: database uses order %d, %d requested", ErrTreeOrderMismatch, header.t, t)
+	}
+	if opts.KeyMode != KeyModeDefault && opts.KeyMode != header.keyMode {
+		return nil, fmt.Errorf("%w: database uses %s keys, %s requested", ErrKeyModeMismatch, header.keyMode, opts.KeyMode)
+	}
+	if opts.CipherSuite != CipherSuiteDefault && opts.CipherSuite != header.suite {
+		return nil, fmt.Errorf("%w: database uses %s, %s requested", ErrCipherSuiteMismatch, header.suite, opts.CipherSuite)
+	}
+	if _, ok := suites[header.suite]; !ok {
+		return nil, fmt.Errorf("database uses unsupported cipher suite %s", header.suite)
+	}
+	if !header.keyMode.supported() {
+		return nil, fmt.Errorf("database uses unsupported key mode %s", header.keyMode)
+	}
+	b.keyMode = header.keyMode
+	b.cipherSuite = header.suite
+	if len(keySet.HMACKey) == 0 && b.keyMode != KeyModePlain {
+		return nil, fmt.Errorf("HMAC key is empty; only %s keys can be stored without one", KeyModePlain)
+	}
+
+	// Rotations that had not finished resume with their old keys, which
+	// lookups and reads must fall back to before the log is replayed
+	var rotation *keyRotation
+	if keySet.PreviousEncryptionKey != nil {
+		rotation = b.newKeyRotation(keySet.PreviousEncryptionKey, keySet.EncryptionKey)
+		b.rotation.Store(rotation)
+	}
+	var reindex *hmacRotation
+	if keySet.PreviousHMACKey != nil && b.keyMode != KeyModePlain {
+		reindex = &hmacRotation{oldKey: keySet.PreviousHMACKey, newKey: keySet.HMACKey}
+		b.hmacRotation.Store(reindex)
+	}
+	if b.pager.meta.root != 0 {
+		if err := b.checkKeys(b.pager.meta.keys); err != nil {
+			return nil, err
+		}
+	}
+
+	b.checkpointLogSize = opts.CheckpointLogSize
+	if b.checkpointLogSize == 0 {
+		b.checkpointLogSize = DefaultCheckpointLogSize
+	} else if b.checkpointLogSize < 0 {
+		b.checkpointLogSize = 0
+	}
+
 	// Open log file
 	b.logFile, err = os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
+	info, err := b.logFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b.logSize = info.Size()
+	if b.logSize < logHeaderSize {
+		// A new log, or one whose header write was torn before any record followed it
+		if err := b.logFile.Truncate(0); err != nil {
+			return nil, err
+		}
+		if err := b.initLog(); err != nil {
+			return nil, err
+		}
+	}
+	b.wal = newLogWriter(b.logFile)
 
 	if err := b.LoadDB(); err != nil {
 		return nil, err
 	}
 
-	if err := b.LoadLog(encryptionKey, nonce); err != nil {
+	b.lsn = b.pager.meta.lsn
+	if err := b.LoadLog(); err != nil {
 		return nil, err
 	}
 
+	if err := b.wal.setMode(opts.Durability, opts.SyncInterval); err != nil {
+		return nil, err
+	}
+	b.stop = make(chan struct{})
+	if opts.CheckpointInterval > 0 {
+		go b.checkpointLoop(opts.CheckpointInterval, b.stop)
+	}
+	expiryInterval := opts.ExpiryInterval
+	if expiryInterval == 0 {
+		expiryInterval = DefaultExpiryInterval
+	}
+	if expiryInterval > 0 {
+		go b.expiryLoop(expiryInterval, b.stop)
+	}
+	if rotation != nil {
+		b.startRotation(rotation)
+	}
+	if reindex != nil {
+		b.startReindex(reindex)
+	}
+
 	return b, nil
 }
 
-// Insert a key-value pair and write to the log.
-func (b *BTree) Insert(key string, value, encryptionKey, nonce []byte) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// Insert a key-value pair and write to the log, replacing the value of the key if it
+// is already present; see Put with PutUpsert.
+// It returns once the log record is durable.
+func (b *BTree) Insert(key string, value []byte) error {
+	return b.Put(key, value, PutUpsert)
+}
 
-	encValue, err := b.encrypt(value, encryptionKey, nonce)
+// newKeyValue encrypts a value, and the key name unless keys are stored in plaintext,
+// into a key-value pair ready for insertion.
+func (b *BTree) newKeyValue(key string, value []byte) (*KeyValue, error) {
+	hKey := b.indexKey(key)
+	encValue, err := b.encrypt(value, b.valueKeys(), hKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	kv := &KeyValue{Key: b.hashKey(key), Value: encValue}
-
-	root := b.root
-	if root == nil {
-		b.root = &Node{
-			isLeaf: true,
-			keys:   []*KeyValue{kv},
+	kv := &KeyValue{Key: hKey, Value: encValue}
+	if b.keyMode != KeyModePlain {
+		kv.EncryptedKey, err = b.encrypt([]byte(key), b.nameKeys(), hKey)
+		if err != nil {
+			return nil, err
 		}
-		b.logOperation("CREATE", key, encValue, false) // Log normally
-		return nil
 	}
+	return kv, nil
+}
 
+// insertKV inserts a key-value pair, splitting the root first when it is full.
+func (b *BTree) insertKV(kv *KeyValue) error {
+	root := b.root
 	if root.numKeys == 2*b.t-1 {
 		newRoot := &Node{children: []int64{root.offset}}
-		b.splitChild(newRoot, 0, root)
-		b.root = newRoot
-		b.insertNonFull(newRoot, kv)
-
-		// Write the new root to disk
-		if err := b.writeRoot(); err != nil {
+		if _, err := b.writeNode(newRoot); err != nil {
 			return err
 		}
+		if err := b.splitChild(newRoot, 0, root); err != nil {
+			return err
+		}
+		b.root = newRoot
+		root = newRoot
 	}
+	return b.insertNonFull(root, kv)
+}
 
-	b.insertNonFull(root, kv)
-	b.logOperation("CREATE", key, encValue, false) // Log normally
-	return nil
+// Update an existing key-value pair and log the operation; see Put with PutUpdateOnly.
+// The key keeps its expiry time, see Expire.
+// It returns once the log record is durable.
+func (b *BTree) Update(key string, newValue []byte) error {
+	return b.Put(key, newValue, PutUpdateOnly)
+}
+
+// Delete removes a key from the B-tree and logs the operation.
+// Nodes emptied by merges are released to the pager, and the tree
+// shrinks by one level when the root runs out of keys.
+// It returns once the log record is durable.
+func (b *BTree) Delete(key string) error {
+	lsn, err := b.applyDelete(key)
+	if err != nil {
+		return err
+	}
+	return b.waitDurable(lsn)
 }
 
-// Update an existing key-value pair and log the operation.
-func (b *BTree) Update(key string, newValue, encryptionKey, nonce []byte) error {
+// applyDelete applies a delete under the tree lock and returns the LSN of its log record.
+func (b *BTree) applyDelete(key string) (uint64, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	hKey := b.hashKey(key)
-	node := b.search(b.root, hKey)
-	if node == nil {
-		return errors.New("key not found")
+	if b.failed != nil {
+		return 0, b.failed
 	}
 
-	encValue, err := b.encrypt(newValue, encryptionKey, nonce)
+	found, err := b.removeKey(b.indexKey(key))
+	if err == nil && !found {
+		found, err = b.removePrevious(key)
+	}
 	if err != nil {
-		return err
+		return 0, b.abort(err)
+	}
+	if !found {
+		// Nodes rebalanced on the way down still hold the same keys
+		b.modCount++
+		return 0, errors.New("key not found")
 	}
 
-	node.Value = encValue
-	b.logOperation("UPDATE", key, encValue, false)
-	return nil
+	return b.commitOp(LogEntry{Operation: "DELETE", Key: key})
 }
 
-// Delete removes a key from the B-tree, starting from the given node.
+// removeKey deletes a hashed key and shrinks the tree by one level when the root runs out of keys.
+func (b *BTree) removeKey(key string) (bool, error) {
+	found, err := b.deleteFrom(b.root, key)
+	if err != nil || !found {
+		return found, err
+	}
+
+	if b.root.numKeys == 0 && !b.root.isLeaf {
+		oldRoot := b.root
+		newRoot, err := b.readNode(oldRoot.children[0])
+		if err != nil {
+			return false, fmt.Errorf("failed to load new root node: %w", err)
+		}
+		b.root = newRoot
+		b.freeNode(oldRoot)
+	}
+	return true, nil
+}
+
+// deleteFrom removes a hashed key from the subtree rooted at node.
 // It ensures that after deletion, nodes have the correct number of keys, merging or borrowing from siblings if necessary.
 // Nodes and their children are written back to disk as necessary.
-func (b *BTree) Delete(node *Node, key string) error {
+func (b *BTree) deleteFrom(node *Node, key string) (bool, error) {
 	i := 0
 	for i < node.numKeys && key > node.keys[i].Key {
 		i++
@@ -395,90 +747,139 @@ func (b *BTree) Delete(node *Node, key string) error {
 
 	if i < node.numKeys && key == node.keys[i].Key {
 		if node.isLeaf {
-			node.keys = append(node.keys[:i], node.keys[i+1:]...)
+			node.keys = slices.Delete(node.keys, i, i+1)
 			node.numKeys--
 
 			// Write the modified node back to disk
 			if _, err := b.writeNode(node); err != nil {
-				return err
-			}
-		} else {
-			if err := b.deleteInternalNode(node, i); err != nil {
-				return err
+				return false, err
 			}
+			return true, nil
 		}
-	} else if !node.isLeaf {
-		// Load child and recurse
-		child, err := b.readNode(node.children[i]) // Fix: Handle the error return
-		if err != nil {
-			return fmt.Errorf("failed to load child node: %w", err)
+		if err := b.deleteInternalNode(node, i); err != nil {
+			return false, err
 		}
+		return true, nil
+	}
 
-		if child.numKeys < b.t {
-			if err := b.fill(node, i); err != nil {
-				return err
-			}
-		}
+	if node.isLeaf {
+		return false, nil
+	}
 
-		if err := b.Delete(child, key); err != nil {
-			return err
+	// Load child and make sure it has at least t keys before descending
+	child, err := b.readNode(node.children[i])
+	if err != nil {
+		return false, fmt.Errorf("failed to load child node: %w", err)
+	}
+
+	if child.numKeys < b.t {
+		if err := b.fill(node, i); err != nil {
+			return false, err
+		}
+		// A merge with the previous sibling moves the key range one child to the left
+		if i > node.numKeys {
+			i = node.numKeys
+		}
+		child, err = b.readNode(node.children[i])
+		if err != nil {
+			return false, fmt.Errorf("failed to load child node: %w", err)
 		}
 	}
 
+	found, err := b.deleteFrom(child, key)
+	if err != nil {
+		return false, err
+	}
+
 	// Write the modified node back to disk
 	if _, err := b.writeNode(node); err != nil {
-		return err
+		return false, err
 	}
-
-	b.logOperation("DELETE", key, nil, false)
-	return nil
+	return found, nil
 }
 
 // Read retrieves and decrypts a value.
-func (b *BTree) Read(key string, encryptionKey, nonce []byte) ([]byte, error) {
+// It returns ErrIntegrity if the stored value does not authenticate under the key,
+// and ErrWrongKey if it was sealed with another encryption key.
+// During a key rotation, a value still under the old key is re-encrypted once read.
+// An expired key is reported as not found and deleted.
+func (b *BTree) Read(key string) ([]byte, error) {
 	b.mu.RLock()
-	defer b.mu.RUnlock()
 
-	hKey := b.hashKey(key)
-	item := b.search(b.root, hKey)
+	if b.failed != nil {
+		b.mu.RUnlock()
+		return nil, b.failed
+	}
+
+	item, hKey := b.find(key)
 	if item == nil {
+		b.mu.RUnlock()
+		return nil, errors.New("key not found")
+	}
+	if item.expired(time.Now()) {
+		b.mu.RUnlock()
+		b.expireKey(hKey)
 		return nil, errors.New("key not found")
 	}
 
-	decValue, err := b.decrypt(item.Value, encryptionKey, nonce)
+	decValue, err := b.decrypt(item.Value, b.valueKeys(), hKey)
+	r := b.activeRotation()
+	stale := err == nil && r != nil && r.stale(*item)
+	b.mu.RUnlock()
 	if err != nil {
 		return nil, err
 	}
+
+	if stale {
+		b.reencryptStale(r, hKey)
+	}
 	return decValue, nil
 }
 
-// LoadDB loads the B-tree structure from the database file.
-func (b *BTree) LoadDB() error {
-	file, err := os.Open(b.dbName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+// find returns the entry of key and the index key it is stored under, falling
+// back to the HMAC key being rotated out. The entry is nil if key is not in
+// the tree.
+func (b *BTree) find(key string) (*KeyValue, string) {
+	hKey := b.indexKey(key)
+	item := b.search(b.root, hKey)
+	if old, ok := b.previousIndexKey(key); item == nil && ok {
+		hKey = old
+		item = b.search(b.root, hKey)
 	}
-	defer file.Close()
+	return item, hKey
+}
 
-	// Only load the root node's metadata, and defer loading other nodes on access.
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(&b.root); err != nil {
-		return err
-	}
+// DecryptValue decrypts the value of a key-value pair returned by a Cursor or Iterator.
+func (b *BTree) DecryptValue(kv KeyValue) ([]byte, error) {
+	return b.decrypt(kv.Value, b.valueKeys(), kv.Key)
+}
 
+// LoadDB loads the B-tree structure from the database file.
+func (b *BTree) LoadDB() error {
 	// Initialize an empty root if it's a new database
-	if b.root == nil {
+	if b.pager.meta.root == 0 {
 		b.root = &Node{isLeaf: true}
+		if _, err := b.writeNode(b.root); err != nil {
+			return err
+		}
+		return b.writeRoot(b.keyState())
+	}
+
+	// Only load the root node, and defer loading other nodes on access.
+	root, err := b.readNode(int64(b.pager.meta.root) * pageSize)
+	if err != nil {
+		return fmt.Errorf("failed to load root node: %w", err)
 	}
+	b.root = root
 	return nil
 }
 
 // LoadLog replays the operation log to restore the latest state.
-func (b *BTree) LoadLog(encryptionKey, nonce []byte) error {
-	file, err := os.Open(b.logName)
+// Records up to the LSN of the last checkpoint are already part of the tree and are skipped.
+// Replay stops at the first torn or corrupt record, see Recovery for what was skipped.
+// When anything was replayed or skipped, a checkpoint is taken so the log starts afresh.
+func (b *BTree) LoadLog() error {
+	file, err := os.Open(filepath.Join(b.dbPath, b.logName))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -487,152 +888,319 @@ func (b *BTree) LoadLog(encryptionKey, nonce []byte) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
+	reader := bufio.NewReader(file)
+	header, err := readLogHeader(reader)
+	if err != nil {
+		return err
+	}
+	if err := b.pager.header.checkLog(header); err != nil {
+		return err
+	}
+
+	info := RecoveryInfo{Offset: logHeaderSize}
 	for {
-		var entry LogEntry
-		if err := decoder.Decode(&entry); err != nil {
-			if err == io.EOF {
-				break
+		entry, n, err := readLogRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && info.LastLSN != 0 && entry.LSN != info.LastLSN+1 {
+			err = fmt.Errorf("%w: LSN %d follows %d", ErrCorruptLogRecord, entry.LSN, info.LastLSN)
+		}
+		if err == nil && entry.LSN > b.lsn+1 {
+			err = fmt.Errorf("%w: LSN %d follows checkpoint at %d", ErrCorruptLogRecord, entry.LSN, b.lsn)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrCorruptLogRecord) {
+				return err
 			}
-			return err
+			info.Err = err
+			break
+		}
+		info.Offset += n
+		info.LastLSN = entry.LSN
+		if entry.LSN <= b.lsn {
+			continue
 		}
 
-		// Replay the log but skip writing new logs during replay
-		switch entry.Operation {
-		case "CREATE":
-			b.Insert(entry.Key, entry.Value, encryptionKey, nonce)
-			b.logOperation("CREATE", entry.Key, entry.Value, true) // Skip logging
-		case "DELETE":
-			b.Delete(b.root, entry.Key)
-			b.logOperation("DELETE", entry.Key, nil, true) // Skip logging
+		// Replay the log; records are applied as stored, see replayEntry
+		if err := b.replayEntry(entry); err != nil {
+			return err
 		}
+		b.lsn = entry.LSN
+		info.Replayed++
 	}
-	return nil
-}
 
-// logOperation logs an operation (CREATE/UPDATE/DELETE) to the log file.
-// If skipLog is true, the operation will not be logged, typically used during log replay.
-func (b *BTree) logOperation(op, key string, value []byte, skipLog bool) error {
-	if skipLog {
-		return nil // Skip logging if we're replaying logs
+	stat, err := file.Stat()
+	if err != nil {
+		return err
 	}
-	entry := LogEntry{
-		Operation: op,
-		Key:       key,
-		Value:     value,
+	info.Skipped = stat.Size() - info.Offset
+	b.recovery = info
+	if info.Err != nil {
+		fmt.Printf("Log replay stopped at offset %d, %d bytes skipped: %v\n", info.Offset, info.Skipped, info.Err)
 	}
-	encoder := gob.NewEncoder(b.logFile)
-	if err := encoder.Encode(entry); err != nil {
-		return err
+
+	if info.Replayed == 0 && info.Skipped == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.checkpoint()
+}
+
+// Recovery reports what the replay of the operation log found when the tree was opened.
+func (b *BTree) Recovery() RecoveryInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.recovery
+}
+
+// logOperation queues an operation (CREATE/UPDATE/DELETE/BATCH) for the log file under the next LSN
+// and returns that LSN; wal.wait makes it durable.
+func (b *BTree) logOperation(entry LogEntry) (uint64, error) {
+	entry.LSN = b.lsn + 1
+	entry.Timestamp = time.Now()
+	record, err := encodeLogRecord(entry)
+	if err != nil {
+		return 0, err
 	}
-	return b.logFile.Sync() // Sync the log file to disk after writing
+	b.wal.append(record, entry.LSN)
+	b.logSize += int64(len(record))
+	b.lsn = entry.LSN
+	return entry.LSN, nil
 }
 
-// encrypt encrypts the provided data using XChaCha20 and returns the encrypted result.
-// It uses the encryptionKey and nonce to perform the encryption.
-func (b *BTree) encrypt(data, encryptionKey, nonce []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(encryptionKey)
+// Encrypted values are the format byte valueFormat, the cipher suite they
+// were sealed with (see CipherSuite), the ID of the key they were sealed with (see keyID), a random nonce of the
+// suite's size and the ciphertext, sealed with the header and the key the
+// value is stored under as associated data, so a value copied to another key
+// no longer authenticates.
+const valueFormat byte = 0x01
+
+// valueHeaderSize is the size of the format byte, cipher suite and key ID of
+// a value.
+const valueHeaderSize = 6
+
+// ErrIntegrity is returned when an encrypted value fails authentication: it
+// was modified or moved from another key.
+var ErrIntegrity = errors.New("value failed integrity check")
+
+// errUnknownValueFormat is returned for a value that is not in a known format.
+var errUnknownValueFormat = errors.New("encrypted value is in an unknown format")
+
+// encrypt encrypts the provided data with the cipher suite of the tree under a fresh random nonce,
+// bound to the index key it is stored under, with the current key of keys. It returns the
+// header and the nonce followed by the encrypted result.
+func (b *BTree) encrypt(data []byte, keys keyRing, indexKey string) ([]byte, error) {
+	aead, err := b.cipherSuite.newAEAD(keys.current)
 	if err != nil {
 		return nil, err
 	}
-	return aead.Seal(nil, nonce, data, nil), nil
+	n := aead.NonceSize()
+	out := make([]byte, valueHeaderSize+n, valueHeaderSize+n+len(data)+aead.Overhead())
+	out[0] = valueFormat
+	out[1] = byte(b.cipherSuite)
+	binary.BigEndian.PutUint32(out[2:valueHeaderSize], keyID(keys.current))
+	if _, err := rand.Read(out[valueHeaderSize:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := out[valueHeaderSize:]
+	return aead.Seal(out, nonce, data, valueAD(out[:valueHeaderSize], indexKey)), nil
+}
+
+// valueAD returns the associated data a value with the given header is sealed with.
+func valueAD(header []byte, indexKey string) []byte {
+	return append(slices.Clone(header), indexKey...)
+}
+
+// valueHeader returns the cipher suite a value was sealed with and the size
+// of its header. It returns false for values in an unknown format.
+func valueHeader(data []byte) (CipherSuite, int, bool) {
+	if len(data) < valueHeaderSize || data[0] != valueFormat {
+		return 0, 0, false
+	}
+	return CipherSuite(data[1]), valueHeaderSize, true
+}
+
+// valueKeyID returns the ID of the key a value was sealed with, or 0 if it
+// is in an unknown format.
+func valueKeyID(data []byte) uint32 {
+	_, size, ok := valueHeader(data)
+	if !ok {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data[size-4 : size])
 }
 // GetRoot returns the root node of the BTree.
 func (b *BTree) GetRoot() *Node {
 	return b.root
 }
-// decrypt decrypts the provided encrypted data using XChaCha20.
-// It uses the encryptionKey and nonce to perform the decryption and returns the decrypted result.
-func (b *BTree) decrypt(data, encryptionKey, nonce []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(encryptionKey)
+// decrypt decrypts the provided encrypted data and returns the decrypted result. It uses the
+// cipher suite, key and nonce recorded with the value and checks that the value belongs to
+// indexKey.
+func (b *BTree) decrypt(data []byte, keys keyRing, indexKey string) ([]byte, error) {
+	suite, size, ok := valueHeader(data)
+	if !ok {
+		return nil, errUnknownValueFormat
+	}
+	key, err := keys.open(valueKeyID(data))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	n := aead.NonceSize()
+	if len(data) < size+n+aead.Overhead() {
+		return nil, ErrIntegrity
+	}
+	nonce, ciphertext := data[size:size+n], data[size+n:]
+	plain, err := aead.Open(nil, nonce, ciphertext, valueAD(data[:size], indexKey))
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return plain, nil
+}
+
+// decryptLegacy decrypts a value imported from v1.2.4, sealed with
+// XChaCha20-Poly1305 under key and the shared nonce.
+func (b *BTree) decryptLegacy(data, key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
 		return nil, err
 	}
-	return aead.Open(nil, nonce, data, nil)
+	plain, err := aead.Open(nil, b.legacyNonce, data, nil)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return plain, nil
 }
 
-// hashKey hashes the provided key using HMAC with SHA-256.
+// keyNameKey derives the key used to encrypt key names from the value
+// encryption key, so names and values are never sealed under the same key.
+func (b *BTree) keyNameKey(encryptionKey []byte) []byte {
+	mac := hmac.New(sha256.New, encryptionKey)
+	mac.Write([]byte("kayveedb key name"))
+	return mac.Sum(nil)
+}
+
+// hashKey hashes the provided key using HMAC with SHA-256 under hmacKey.
 // It returns the hashed key as a hexadecimal string.
-func (b *BTree) hashKey(key string) string {
-	mac := hmac.New(func() hash.Hash { return sha256.New() }, b.hmacKey)
+func (b *BTree) hashKey(hmacKey []byte, key string) string {
+	mac := hmac.New(func() hash.Hash { return sha256.New() }, hmacKey)
 	mac.Write([]byte(key))
 	return fmt.Sprintf("%x", mac.Sum(nil))
 }
 
-// writeNode writes the given node to the database file and returns its offset.
+// writeNode marks the node as changed and returns its offset.
+// A node that has never been written is assigned a page first. A node whose
+// page belongs to the committed tree is moved to a new page instead of being
+// overwritten, and its old offset is recorded so parents pick up the new one
+// when they are flushed. The node is kept dirty in the cache until flushNode
+// writes it out.
 func (b *BTree) writeNode(node *Node) (int64, error) {
-	dbFilePath := filepath.Join(b.dbPath, b.dbName)
+	if node.offset == 0 {
+		id := b.pager.allocate()
+		node.offset = int64(id) * pageSize
+		node.pages = []uint64{id}
+	} else if !b.pager.isWritable(uint64(node.offset / pageSize)) {
+		oldOffset := node.offset
+		b.pager.release(node.pages...)
+		b.cache.Remove(oldOffset)
 
-	file, err := os.OpenFile(dbFilePath, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return 0, fmt.Errorf("failed to open dbName file: %w", err)
+		id := b.pager.allocate()
+		node.offset = int64(id) * pageSize
+		node.pages = []uint64{id}
+		b.relocated[oldOffset] = node.offset
 	}
-	defer file.Close()
 
-	// Move to the end of the file to append the new node
-	offset, err := file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return 0, fmt.Errorf("failed to append new node: %w", err)
+	// Add the node to the cache and mark it as dirty
+	b.cache.Put(node.offset, node, true)
+
+	return node.offset, nil
+}
+
+// flushNode encodes a node and writes it over its page chain.
+func (b *BTree) flushNode(offset int64, node *Node) error {
+	// Point the node at the new copies of children moved since the last commit
+	for i, child := range node.children {
+		if newOffset, ok := b.relocated[child]; ok {
+			node.children[i] = newOffset
+		}
 	}
 
-	// Encode and write the node to disk
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(node); err != nil {
-		return 0, fmt.Errorf("failed to encode node: %w", err)
+	data, err := encodeNode(node)
+	if err != nil {
+		return fmt.Errorf("failed to encode node at offset %d: %w", offset, err)
 	}
 
-	// Add the node to the cache and mark it as dirty
-	b.cache.Put(offset, node, true)
+	pages := node.pages
+	if len(pages) == 0 {
+		pages = []uint64{uint64(offset / pageSize)}
+	}
+	node.pages, err = b.pager.writeChain(pages, data)
+	if err != nil {
+		return fmt.Errorf("failed to write node at offset %d: %w", offset, err)
+	}
+	return nil
+}
 
-	return offset, nil
+// freeNode releases the pages of a node that is no longer part of the tree.
+func (b *BTree) freeNode(node *Node) {
+	b.cache.Remove(node.offset)
+	b.pager.release(node.pages...)
 }
 
 // readNode reads a node from the database file at the given offset.
 func (b *BTree) readNode(offset int64) (*Node, error) {
-	dbFilePath := filepath.Join(b.dbPath, b.dbName)
+	if newOffset, ok := b.relocated[offset]; ok {
+		offset = newOffset
+	}
+	if b.root != nil && offset == b.root.offset {
+		return b.root, nil
+	}
 
 	// Check cache first
 	if node, ok := b.cache.Get(offset); ok {
 		return node, nil
 	}
 
-	// If not found in cache, read from disk
-	file, err := os.OpenFile(dbFilePath, os.O_RDONLY, 0644)
+	// If not found in cache, read the node's page chain from disk
+	data, pages, err := b.pager.readChain(uint64(offset / pageSize))
 	if err != nil {
-		return nil, fmt.Errorf("failed to open dbName file: %w", err)
+		return nil, fmt.Errorf("failed reading node at offset %d: %w", offset, err)
 	}
-	defer file.Close()
 
-	// Seek to the node's position in the file
-	_, err = file.Seek(offset, io.SeekStart)
+	node, err := decodeNode(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed seeking node at offset %d: %w", offset, err)
-	}
-
-	// Decode the node from the file
-	var node Node
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(&node); err != nil {
 		return nil, fmt.Errorf("failed to decode node at offset %d: %w", offset, err)
 	}
+	node.offset = offset
+	node.pages = pages
 
 	// Add the node to the cache as not dirty (it's fresh from disk)
-	b.cache.Put(offset, &node, false)
+	b.cache.Put(offset, node, false)
 
-	return &node, nil
+	return node, nil
 }
+
 // splitChild splits a full child node into two and adjusts the parent accordingly.
 // The node and its children are written back to disk after the split.
 func (b *BTree) splitChild(parent *Node, i int, fullChild *Node) error {
 	t := b.t
+	median := fullChild.keys[t-1]
 
 	// Create a new node that will be the sibling of the full child
 	newChild := &Node{
-		isLeaf:   fullChild.isLeaf,
-		keys:     append([]*KeyValue{}, fullChild.keys[t:]...), // Copy the second half of the keys
-		children: append([]int64{}, fullChild.children[t:]...),  // Copy the second half of the children
-		numKeys:  t - 1,
+		isLeaf: fullChild.isLeaf,
+		keys:   append([]*KeyValue{}, fullChild.keys[t:]...), // Copy the second half of the keys
 	}
+	if !fullChild.isLeaf {
+		newChild.children = append([]int64{}, fullChild.children[t:]...) // Copy the second half of the children
+	}
+	newChild.numKeys = len(newChild.keys)
 
 	// Write the new child to disk and get its offset
 	newChildOffset, err := b.writeNode(newChild)
@@ -642,7 +1210,9 @@ func (b *BTree) splitChild(parent *Node, i int, fullChild *Node) error {
 
 	// Update the full child
 	fullChild.keys = fullChild.keys[:t-1]
-	fullChild.children = fullChild.children[:t]
+	if !fullChild.isLeaf {
+		fullChild.children = fullChild.children[:t]
+	}
 	fullChild.numKeys = t - 1
 
 	// Write the updated full child back to disk
@@ -651,8 +1221,8 @@ func (b *BTree) splitChild(parent *Node, i int, fullChild *Node) error {
 	}
 
 	// Update the parent node with the new child
-	parent.children = append(parent.children[:i+1], append([]int64{newChildOffset}, parent.children[i+1:]...)...)
-	parent.keys = append(parent.keys[:i], append([]*KeyValue{fullChild.keys[t-1]}, parent.keys[i:]...)...)
+	parent.children = slices.Insert(parent.children, i+1, newChildOffset)
+	parent.keys = slices.Insert(parent.keys, i, median)
 	parent.numKeys++
 
 	// Write the parent node back to disk
@@ -666,7 +1236,7 @@ func (b *BTree) splitChild(parent *Node, i int, fullChild *Node) error {
 // insertNonFull inserts a key into a node that is not full.
 // If the node is a leaf, it inserts the key directly. Otherwise, it recurses into the appropriate child.
 // The node and its children are written back to disk after the insertion.
-func (b *BTree) insertNonFull(node *Node, kv *KeyValue) {
+func (b *BTree) insertNonFull(node *Node, kv *KeyValue) error {
 	i := node.numKeys - 1
 
 	if node.isLeaf {
@@ -680,38 +1250,45 @@ func (b *BTree) insertNonFull(node *Node, kv *KeyValue) {
 		node.numKeys++
 
 		// Write the updated node back to disk
-		b.writeNode(node)
-	} else {
-		// Traverse the tree only when necessary
-		for i >= 0 && kv.Key < node.keys[i].Key {
-			i--
-		}
-		i++
+		_, err := b.writeNode(node)
+		return err
+	}
 
-		// Load the child node only when required
-		child, err := b.readNode(node.children[i])
-		if err != nil {
-			fmt.Printf("Error reading child node: %v\n", err)
-			return
-		}
+	// Traverse the tree only when necessary
+	for i >= 0 && kv.Key < node.keys[i].Key {
+		i--
+	}
+	i++
 
-		if child.numKeys == 2*b.t-1 {
-			// If the child is full, split it
-			b.splitChild(node, i, child)
-			if kv.Key > node.keys[i].Key {
-				i++
-			}
+	// Load the child node only when required
+	child, err := b.readNode(node.children[i])
+	if err != nil {
+		return fmt.Errorf("failed to read child node: %w", err)
+	}
+
+	if child.numKeys == 2*b.t-1 {
+		// If the child is full, split it
+		if err := b.splitChild(node, i, child); err != nil {
+			return err
+		}
+		if kv.Key > node.keys[i].Key {
+			i++
 		}
 
 		// Re-read the child node after the split
 		child, err = b.readNode(node.children[i])
 		if err != nil {
-			fmt.Printf("Error re-reading child node: %v\n", err)
-			return
+			return fmt.Errorf("failed to re-read child node: %w", err)
 		}
+	}
 
-		b.insertNonFull(child, kv)
+	if err := b.insertNonFull(child, kv); err != nil {
+		return err
 	}
+
+	// Rewrite the node so it points at the child's new copy
+	_, err = b.writeNode(node)
+	return err
 }
 
 // deleteInternalNode handles deletion of a key in an internal node.
@@ -726,9 +1303,12 @@ func (b *BTree) deleteInternalNode(node *Node, idx int) error {
 		return fmt.Errorf("failed to read predecessor child: %w", err)
 	}
 	if predChild.numKeys >= t {
-		pred := b.getPredecessor(node, idx)
+		pred, err := b.getPredecessor(node, idx)
+		if err != nil {
+			return err
+		}
 		node.keys[idx] = pred
-		if err := b.Delete(predChild, pred.Key); err != nil {
+		if _, err := b.deleteFrom(predChild, pred.Key); err != nil {
 			return err
 		}
 		if _, err := b.writeNode(node); err != nil {
@@ -743,9 +1323,12 @@ func (b *BTree) deleteInternalNode(node *Node, idx int) error {
 		return fmt.Errorf("failed to read successor child: %w", err)
 	}
 	if succChild.numKeys >= t {
-		succ := b.getSuccessor(node, idx)
+		succ, err := b.getSuccessor(node, idx)
+		if err != nil {
+			return err
+		}
 		node.keys[idx] = succ
-		if err := b.Delete(succChild, succ.Key); err != nil {
+		if _, err := b.deleteFrom(succChild, succ.Key); err != nil {
 			return err
 		}
 		if _, err := b.writeNode(node); err != nil {
@@ -762,7 +1345,7 @@ func (b *BTree) deleteInternalNode(node *Node, idx int) error {
 	if err != nil {
 		return fmt.Errorf("failed to read child node: %w", err)
 	}
-	if err := b.Delete(child, key.Key); err != nil {
+	if _, err := b.deleteFrom(child, key.Key); err != nil {
 		return err
 	}
 	if _, err := b.writeNode(node); err != nil {
@@ -771,7 +1354,9 @@ func (b *BTree) deleteInternalNode(node *Node, idx int) error {
 
 	return nil
 }
+
 // merge merges the child at index idx with its sibling.
+// The sibling's pages are released to the pager.
 func (b *BTree) merge(node *Node, idx int) error {
 	child, err := b.readNode(node.children[idx])
 	if err != nil {
@@ -792,8 +1377,8 @@ func (b *BTree) merge(node *Node, idx int) error {
 	}
 
 	// Remove the key from the current node and the sibling
-	node.keys = append(node.keys[:idx], node.keys[idx+1:]...)
-	node.children = append(node.children[:idx+1], node.children[idx+2:]...)
+	node.keys = slices.Delete(node.keys, idx, idx+1)
+	node.children = slices.Delete(node.children, idx+1, idx+2)
 
 	child.numKeys += sibling.numKeys + 1
 	node.numKeys--
@@ -806,6 +1391,7 @@ func (b *BTree) merge(node *Node, idx int) error {
 		return err
 	}
 
+	b.freeNode(sibling)
 	return nil
 }
 
@@ -839,14 +1425,14 @@ func (b *BTree) fill(node *Node, idx int) error {
 		}
 	}
 
-	// Merge the child with either its previous or next sibling
+	// Merge the child with either its next or previous sibling
 	if idx != node.numKeys {
 		if err := b.merge(node, idx); err != nil {
-			return fmt.Errorf("failed to merge with previous sibling: %w", err)
+			return fmt.Errorf("failed to merge with next sibling: %w", err)
 		}
 	} else {
 		if err := b.merge(node, idx-1); err != nil {
-			return fmt.Errorf("failed to merge with next sibling: %w", err)
+			return fmt.Errorf("failed to merge with previous sibling: %w", err)
 		}
 	}
 	return nil
@@ -864,12 +1450,14 @@ func (b *BTree) borrowFromPrev(node *Node, idx int) error {
 	}
 
 	// Move the key from the parent down to the child
-	child.keys = append([]*KeyValue{node.keys[idx-1]}, child.keys...)
+	child.keys = slices.Insert(child.keys, 0, node.keys[idx-1])
 	node.keys[idx-1] = sibling.keys[sibling.numKeys-1]
+	sibling.keys = sibling.keys[:sibling.numKeys-1]
 
 	// Move the sibling's last child to the child
 	if !child.isLeaf {
-		child.children = append([]int64{sibling.children[sibling.numKeys]}, child.children...)
+		child.children = slices.Insert(child.children, 0, sibling.children[sibling.numKeys])
+		sibling.children = sibling.children[:sibling.numKeys]
 	}
 
 	sibling.numKeys--
@@ -907,10 +1495,10 @@ func (b *BTree) borrowFromNext(node *Node, idx int) error {
 	// Move the sibling's first child to the child
 	if !child.isLeaf {
 		child.children = append(child.children, sibling.children[0])
-		sibling.children = sibling.children[1:]
+		sibling.children = slices.Delete(sibling.children, 0, 1)
 	}
 
-	sibling.keys = sibling.keys[1:]
+	sibling.keys = slices.Delete(sibling.keys, 0, 1)
 	sibling.numKeys--
 	child.numKeys++
 
@@ -927,31 +1515,66 @@ func (b *BTree) borrowFromNext(node *Node, idx int) error {
 
 	return nil
 }
-// writeRoot writes the root node of the BTree to disk.
-func (b *BTree) writeRoot() error {
-	// Write the root node and get its offset
-	offset, err := b.writeNode(b.root)
-	if err != nil {
+
+// writeRoot commits the tree: it flushes every changed node to its new pages
+// and then atomically switches the superblock to the current root, recording
+// the LSN of the last logged operation and the given key state.
+func (b *BTree) writeRoot(keys keyState) error {
+	if err := b.cache.Flush(); err != nil {
 		return err
 	}
-
-	// Move to the start of the file to write the root offset
-	_, err = b.dbFile.Seek(0, io.SeekStart)
-	if err != nil {
+	if err := b.pager.commit(uint64(b.root.offset/pageSize), b.lsn, keys); err != nil {
 		return err
 	}
+	clear(b.relocated)
+	b.modCount++
+	return nil
+}
 
-	// Encode and write the offset
-	encoder := gob.NewEncoder(b.dbFile)
-	return encoder.Encode(offset)
+// abort discards every change made since the last checkpoint and reloads the
+// committed root. It returns err so callers can use it on their error path.
+// Operations logged since the checkpoint are discarded along with the failed
+// one, so in that case the tree refuses further use with ErrNeedsRecovery
+// until it is reopened and the log is replayed.
+func (b *BTree) abort(err error) error {
+	if b.failed == nil && b.lsn > b.pager.meta.lsn {
+		b.failed = fmt.Errorf("%w: %v", ErrNeedsRecovery, err)
+	}
+	b.cache.Reset()
+	clear(b.relocated)
+	b.modCount++
+	if rbErr := b.pager.rollback(); rbErr != nil {
+		return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+	}
+	if b.pager.meta.root == 0 {
+		b.root = &Node{isLeaf: true}
+		return err
+	}
+	b.root = nil
+	root, rbErr := b.readNode(int64(b.pager.meta.root) * pageSize)
+	if rbErr != nil {
+		return fmt.Errorf("%w (reloading root failed: %v)", err, rbErr)
+	}
+	b.root = root
+	return err
 }
 
 // search looks for a key in the BTree, starting from the given node.
 // It returns the KeyValue pair if found or nil if not found.
 func (b *BTree) search(node *Node, key string) *KeyValue {
+	node, i := b.searchNode(node, key)
 	if node == nil {
 		return nil
 	}
+	return node.keys[i]
+}
+
+// searchNode looks for a key in the BTree, starting from the given node.
+// It returns the node holding the key and the key's index, or nil if not found.
+func (b *BTree) searchNode(node *Node, key string) (*Node, int) {
+	if node == nil {
+		return nil, 0
+	}
 
 	// Find the index where the key would be in the current node
 	i := 0
@@ -959,64 +1582,93 @@ func (b *BTree) search(node *Node, key string) *KeyValue {
 		i++
 	}
 
-	// If the key is found, return the key-value pair
+	// If the key is found, return the node holding it
 	if i < node.numKeys && key == node.keys[i].Key {
-		return node.keys[i]
+		return node, i
 	}
 
 	// If the node is a leaf, stop the search
 	if node.isLeaf {
-		return nil
+		return nil, 0
 	}
 
 	// Recursively search the child node
 	child, err := b.readNode(node.children[i])
 	if err != nil {
 		fmt.Printf("failed to load child node: %v\n", err)
-		return nil
+		return nil, 0
+	}
+
+	return b.searchNode(child, key)
+}
+
+// modifyKey finds a hashed key below node and applies fn to it in place.
+// Every node on the path from node down to the key is rewritten so the
+// change propagates up to the root on commit.
+func (b *BTree) modifyKey(node *Node, key string, fn func(kv *KeyValue) error) (bool, error) {
+	i := 0
+	for i < node.numKeys && key > node.keys[i].Key {
+		i++
 	}
 
-	return b.search(child, key)
+	if i < node.numKeys && key == node.keys[i].Key {
+		if err := fn(node.keys[i]); err != nil {
+			return false, err
+		}
+	} else {
+		if node.isLeaf {
+			return false, nil
+		}
+		child, err := b.readNode(node.children[i])
+		if err != nil {
+			return false, fmt.Errorf("failed to load child node: %w", err)
+		}
+		found, err := b.modifyKey(child, key, fn)
+		if err != nil || !found {
+			return found, err
+		}
+	}
+
+	if _, err := b.writeNode(node); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // getPredecessor finds the predecessor of a key in the BTree.
-func (b *BTree) getPredecessor(node *Node, idx int) *KeyValue {
+func (b *BTree) getPredecessor(node *Node, idx int) (*KeyValue, error) {
 	current, err := b.readNode(node.children[idx])
 	if err != nil {
-		fmt.Printf("failed to read predecessor node: %v\n", err)
-		return nil
+		return nil, fmt.Errorf("failed to read predecessor node: %w", err)
 	}
 
 	// Traverse to the rightmost leaf
 	for !current.isLeaf {
 		current, err = b.readNode(current.children[current.numKeys])
 		if err != nil {
-			fmt.Printf("failed to read child node: %v\n", err)
-			return nil
+			return nil, fmt.Errorf("failed to read child node: %w", err)
 		}
 	}
 
 	// Return the last key of the rightmost node
-	return current.keys[current.numKeys-1]
+	return current.keys[current.numKeys-1], nil
 }
 
 // getSuccessor finds the successor of a key in the BTree.
-func (b *BTree) getSuccessor(node *Node, idx int) *KeyValue {
+func (b *BTree) getSuccessor(node *Node, idx int) (*KeyValue, error) {
 	current, err := b.readNode(node.children[idx+1])
 	if err != nil {
-		fmt.Printf("failed to get successor node: %v\n", err)
-		return nil
+		return nil, fmt.Errorf("failed to get successor node: %w", err)
 	}
 
 	// Traverse to the leftmost leaf
 	for !current.isLeaf {
 		current, err = b.readNode(current.children[0])
 		if err != nil {
-			fmt.Printf("failed to read child node: %v\n", err)
-			return nil
+			return nil, fmt.Errorf("failed to read child node: %w", err)
 		}
 	}
 
 	// Return the first key of the leftmost node
-	return current.keys[0]
+	return current.keys[0], nil
 }
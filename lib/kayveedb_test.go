@@ -0,0 +1,442 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var (
+	testHMACKey       = bytes.Repeat([]byte{0x11}, 32)
+	testEncryptionKey = bytes.Repeat([]byte{0x22}, 32)
+)
+
+// openTestTree opens the database in dir with the test keys and the given
+// cache size, without background checkpoints or expiry sweeps. The log is
+// not synced, which a copy of the files taken by copyDatabase does not need.
+func openTestTree(t *testing.T, dir string, cacheSize int, keyMode KeyMode) *BTree {
+	t.Helper()
+	opts := Options{KeyMode: keyMode, ExpiryInterval: -1, Durability: DurabilityNone}
+	b, err := NewBTreeWithOptions(3, dir, "", "", StaticKeys(testHMACKey, testEncryptionKey, nil), cacheSize, opts)
+	if err != nil {
+		t.Fatalf("failed to open tree: %v", err)
+	}
+	return b
+}
+
+// closeTestTree closes a tree opened by openTestTree.
+func closeTestTree(t *testing.T, b *BTree) {
+	t.Helper()
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close tree: %v", err)
+	}
+}
+
+// copyDatabase copies the database and log files in src to a new directory
+// and returns it. Copying the files of an open tree leaves them as a crash
+// at that point would.
+func copyDatabase(t *testing.T, src string) string {
+	t.Helper()
+	dst := t.TempDir()
+	for _, name := range []string{"kayvee.db", "kayvee.log"} {
+		data, err := os.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+// checkInvariants walks the whole tree, fails the test unless every node holds
+// a valid number of keys in strict order and every leaf is at the same depth,
+// and returns the number of keys.
+func checkInvariants(t *testing.T, b *BTree) int {
+	t.Helper()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	leafDepth := -1
+	var walk func(node *Node, lo, hi string, depth int) int
+	walk = func(node *Node, lo, hi string, depth int) int {
+		if node.numKeys != len(node.keys) {
+			t.Fatalf("node records %d keys but holds %d", node.numKeys, len(node.keys))
+		}
+		if node != b.root && (node.numKeys < b.t-1 || node.numKeys > 2*b.t-1) {
+			t.Fatalf("node holds %d keys", node.numKeys)
+		}
+		for i, kv := range node.keys {
+			if (lo != "" && kv.Key <= lo) || (hi != "" && kv.Key >= hi) || (i > 0 && node.keys[i-1].Key >= kv.Key) {
+				t.Fatalf("key %q is out of order", kv.Key)
+			}
+		}
+		if node.isLeaf {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				t.Fatalf("leaf at depth %d, expected %d", depth, leafDepth)
+			}
+			return node.numKeys
+		}
+		if len(node.children) != node.numKeys+1 {
+			t.Fatalf("node with %d keys has %d children", node.numKeys, len(node.children))
+		}
+		total := node.numKeys
+		for i, offset := range node.children {
+			child, err := b.readNode(offset)
+			if err != nil {
+				t.Fatalf("failed to read child: %v", err)
+			}
+			l, h := lo, hi
+			if i > 0 {
+				l = node.keys[i-1].Key
+			}
+			if i < node.numKeys {
+				h = node.keys[i].Key
+			}
+			total += walk(child, l, h, depth+1)
+		}
+		return total
+	}
+	return walk(b.root, "", "", 0)
+}
+
+// checkModel fails the test unless the tree holds exactly the keys and values
+// of model, out of the keys key(0) to key(n-1).
+func checkModel(t *testing.T, b *BTree, model map[string][]byte, n int) {
+	t.Helper()
+	if count := checkInvariants(t, b); count != len(model) {
+		t.Fatalf("tree holds %d keys, expected %d", count, len(model))
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		value, err := b.Read(key)
+		want, ok := model[key]
+		switch {
+		case !ok && err == nil:
+			t.Fatalf("deleted key %s was read", key)
+		case ok && err != nil:
+			t.Fatalf("failed to read %s: %v", key, err)
+		case ok && !bytes.Equal(value, want):
+			t.Fatalf("%s holds %d bytes, expected %d", key, len(value), len(want))
+		}
+	}
+}
+
+// TestModel applies random inserts, updates and deletes to trees with small
+// caches in every key mode and checks them against a map after checkpoints,
+// reopens and simulated crashes.
+func TestModel(t *testing.T) {
+	const keys = 300
+	for _, keyMode := range []KeyMode{KeyModeHMAC, KeyModePlain} {
+		for _, cacheSize := range []int{0, 1, 4, 50} {
+			t.Run(fmt.Sprintf("%s/cache=%d", keyMode, cacheSize), func(t *testing.T) {
+				rng := rand.New(rand.NewSource(int64(cacheSize)*10 + int64(keyMode)))
+				dir := t.TempDir()
+				b := openTestTree(t, dir, cacheSize, keyMode)
+				model := make(map[string][]byte)
+
+				for step := 1; step <= 2000; step++ {
+					key := fmt.Sprintf("key-%04d", rng.Intn(keys))
+					switch op := rng.Intn(10); {
+					case op < 6:
+						// Some values span overflow pages
+						value := make([]byte, 1+rng.Intn(64))
+						if rng.Intn(20) == 0 {
+							value = make([]byte, pageSize+rng.Intn(2*pageSize))
+						}
+						rng.Read(value)
+						if err := b.Insert(key, value); err != nil {
+							t.Fatalf("step %d: failed to insert %s: %v", step, key, err)
+						}
+						model[key] = value
+					default:
+						err := b.Delete(key)
+						if _, ok := model[key]; ok && err != nil {
+							t.Fatalf("step %d: failed to delete %s: %v", step, key, err)
+						}
+						delete(model, key)
+					}
+
+					switch {
+					case step%250 == 0:
+						if err := b.Checkpoint(); err != nil {
+							t.Fatalf("step %d: checkpoint failed: %v", step, err)
+						}
+					case step%400 == 0:
+						closeTestTree(t, b)
+						b = openTestTree(t, dir, cacheSize, keyMode)
+						checkModel(t, b, model, keys)
+					case step%300 == 0:
+						crashed := openTestTree(t, copyDatabase(t, dir), cacheSize, keyMode)
+						checkModel(t, crashed, model, keys)
+						closeTestTree(t, crashed)
+					}
+				}
+				checkModel(t, b, model, keys)
+				closeTestTree(t, b)
+			})
+		}
+	}
+}
+
+// TestTornLogRecovery damages the tail of the log of a crashed tree and
+// checks that reopening it keeps every record before the damaged one.
+func TestTornLogRecovery(t *testing.T) {
+	damage := map[string]func(log []byte, last int) []byte{
+		"truncated payload": func(log []byte, last int) []byte { return log[:len(log)-3] },
+		"truncated header":  func(log []byte, last int) []byte { return log[:last+logRecordHeaderSize/2] },
+		"flipped byte": func(log []byte, last int) []byte {
+			log[len(log)-1] ^= 0xff
+			return log
+		},
+	}
+	for name, fn := range damage {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			b := openTestTree(t, dir, 10, KeyModeHMAC)
+			for i := 0; i < 20; i++ {
+				if err := b.Insert(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprint("value-", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 20; i < 30; i++ {
+				if err := b.Insert(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprint("value-", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			crashed := copyDatabase(t, dir)
+			closeTestTree(t, b)
+			logPath := filepath.Join(crashed, "kayvee.log")
+			log, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := lastRecordOffset(t, log)
+			if err := os.WriteFile(logPath, fn(log, last), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			b = openTestTree(t, crashed, 10, KeyModeHMAC)
+			info := b.Recovery()
+			if info.Replayed != 9 || info.Offset != int64(last) || info.Skipped == 0 || !errors.Is(info.Err, ErrCorruptLogRecord) {
+				t.Fatalf("unexpected recovery %+v", info)
+			}
+			model := make(map[string][]byte)
+			for i := 0; i < 29; i++ {
+				model[fmt.Sprintf("key-%04d", i)] = []byte(fmt.Sprint("value-", i))
+			}
+			checkModel(t, b, model, 30)
+
+			// The damaged tail was discarded, so new records follow the last valid one
+			if err := b.Insert("key-0029", []byte("again")); err != nil {
+				t.Fatal(err)
+			}
+			closeTestTree(t, b)
+			b = openTestTree(t, crashed, 10, KeyModeHMAC)
+			model["key-0029"] = []byte("again")
+			checkModel(t, b, model, 30)
+			closeTestTree(t, b)
+		})
+	}
+}
+
+// lastRecordOffset returns the offset of the last record in a log file.
+func lastRecordOffset(t *testing.T, log []byte) int {
+	t.Helper()
+	offset, last := logHeaderSize, -1
+	for offset < len(log) {
+		last = offset
+		offset += logRecordHeaderSize + int(binary.BigEndian.Uint32(log[offset:]))
+	}
+	if last == -1 || offset != len(log) {
+		t.Fatalf("log of %d bytes does not end with a complete record", len(log))
+	}
+	return last
+}
+
+// keySetProvider hands out the same key set on every call.
+type keySetProvider struct {
+	keys *KeySet
+}
+
+func (p keySetProvider) LoadKeys() (*KeySet, error) {
+	return p.keys, nil
+}
+
+// TestRefusedOpen checks that an open refused for mismatched options closes
+// both files and zeroes the keys it loaded.
+func TestRefusedOpen(t *testing.T) {
+	dir := t.TempDir()
+	closeTestTree(t, openTestTree(t, dir, 10, KeyModeHMAC))
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files cannot be counted here")
+	}
+	for i := 0; i < 20; i++ {
+		keys := &KeySet{HMACKey: bytes.Clone(testHMACKey), EncryptionKey: bytes.Clone(testEncryptionKey)}
+		_, err := NewBTreeWithOptions(3, dir, "", "", keySetProvider{keys}, 10, Options{KeyMode: KeyModePlain})
+		if !errors.Is(err, ErrKeyModeMismatch) {
+			t.Fatalf("expected ErrKeyModeMismatch, got %v", err)
+		}
+		if !bytes.Equal(keys.EncryptionKey, make([]byte, 32)) || !bytes.Equal(keys.HMACKey, make([]byte, 32)) {
+			t.Fatal("keys were not zeroed")
+		}
+	}
+	after, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) > len(fds) {
+		t.Fatalf("%d files open before, %d after", len(fds), len(after))
+	}
+}
+
+// TestEmptyHMACKey checks that a tree whose keys are derived from the HMAC key
+// cannot be opened without one, as with EnvKeyProvider and no KAYVEEDB_HMAC.
+func TestEmptyHMACKey(t *testing.T) {
+	t.Setenv("KAYVEEDB_TEST_ENCRYPTION", fmt.Sprintf("%x", testEncryptionKey))
+	keys := &EnvKeyProvider{Prefix: "KAYVEEDB_TEST_"}
+	for _, keyMode := range []KeyMode{KeyModeDefault, KeyModeHMAC, KeyModePlain} {
+		b, err := NewBTreeWithOptions(3, t.TempDir(), "", "", keys, 10, Options{KeyMode: keyMode, ExpiryInterval: -1})
+		if keyMode != KeyModePlain {
+			if err == nil {
+				t.Fatalf("%s keys: opened without an HMAC key", keyMode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s keys: %v", keyMode, err)
+		}
+		closeTestTree(t, b)
+	}
+}
+
+// TestUnsupportedKeyMode checks that key modes other than KeyModeHMAC and
+// KeyModePlain are refused, whether requested or recorded in the database.
+func TestUnsupportedKeyMode(t *testing.T) {
+	keys := StaticKeys(testHMACKey, testEncryptionKey, nil)
+	if _, err := NewBTreeWithOptions(3, t.TempDir(), "", "", keys, 10, Options{KeyMode: 0x03}); err == nil {
+		t.Fatal("tree opened with an unknown key mode")
+	}
+
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "kayvee.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPager(file, fileHeader{t: 3, keyMode: 0x03, suite: CipherSuiteXChaCha20Poly1305}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, err := NewBTreeWithOptions(3, dir, "", "", keys, 10, Options{}); err == nil {
+		t.Fatal("database with an unknown key mode was opened")
+	}
+}
+
+// TestKeys checks that Keys and ListKeyNames return the original keys in
+// every key mode, also after a reopen.
+func TestKeys(t *testing.T) {
+	stored := []string{"user:1", "user:2", "user:10", "users", "order:1", "a*b"}
+	patterns := map[string][]string{
+		"*":        {"a*b", "order:1", "user:1", "user:10", "user:2", "users"},
+		"user:*":   {"user:1", "user:10", "user:2"},
+		"user:?":   {"user:1", "user:2"},
+		"user*":    {"user:1", "user:10", "user:2", "users"},
+		"users":    {"users"},
+		`a\*b`:     {"a*b"},
+		"[ou]*:1":  {"order:1", "user:1"},
+		"missing*": nil,
+	}
+	for _, keyMode := range []KeyMode{KeyModeHMAC, KeyModePlain} {
+		dir := t.TempDir()
+		b := openTestTree(t, dir, 10, keyMode)
+		for _, key := range stored {
+			if err := b.Insert(key, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for reopen := 0; reopen < 2; reopen++ {
+			for pattern, want := range patterns {
+				got, err := b.Keys(pattern)
+				slices.Sort(got)
+				if err != nil || !slices.Equal(got, want) {
+					t.Fatalf("%s keys: Keys(%q) returned %q, %v, expected %q", keyMode, pattern, got, err, want)
+				}
+			}
+			names, err := b.ListKeyNames()
+			if err != nil || len(names) != len(stored) {
+				t.Fatalf("%s keys: ListKeyNames returned %q, %v", keyMode, names, err)
+			}
+			closeTestTree(t, b)
+			b = openTestTree(t, dir, 10, keyMode)
+		}
+		closeTestTree(t, b)
+	}
+}
+
+// TestSwappedValues checks that a value moved to another key, or changed in
+// place, fails to read with ErrIntegrity after the tree is reopened.
+func TestSwappedValues(t *testing.T) {
+	for _, keyMode := range []KeyMode{KeyModeHMAC, KeyModePlain} {
+		t.Run(keyMode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			b := openTestTree(t, dir, 10, keyMode)
+			for _, key := range []string{"alpha", "beta", "gamma", "delta"} {
+				if err := b.Insert(key, []byte("value of "+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Rewrite the stored entries as someone with access to the file could
+			b.mu.Lock()
+			alpha, alphaKey := b.find("alpha")
+			beta, betaKey := b.find("beta")
+			gamma, gammaKey := b.find("gamma")
+			alphaValue, betaValue := alpha.Value, beta.Value
+			for _, change := range []struct {
+				key   string
+				value []byte
+			}{
+				{alphaKey, betaValue},
+				{betaKey, alphaValue},
+				{gammaKey, corruptByte(gamma.Value, len(gamma.Value)-1)},
+			} {
+				if _, err := b.modifyKey(b.root, change.key, func(kv *KeyValue) error {
+					kv.Value = change.value
+					return nil
+				}); err != nil {
+					b.mu.Unlock()
+					t.Fatal(err)
+				}
+			}
+			b.mu.Unlock()
+			closeTestTree(t, b)
+
+			b = openTestTree(t, dir, 10, keyMode)
+			defer closeTestTree(t, b)
+			for _, key := range []string{"alpha", "beta", "gamma"} {
+				if _, err := b.Read(key); !errors.Is(err, ErrIntegrity) {
+					t.Fatalf("reading tampered %s returned %v, expected ErrIntegrity", key, err)
+				}
+			}
+			if value, err := b.Read("delta"); err != nil || string(value) != "value of delta" {
+				t.Fatalf("untouched key read as %q, %v", value, err)
+			}
+		})
+	}
+}
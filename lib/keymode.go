@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeyMode selects how keys are stored in the tree. It is chosen when a
+// database is created and recorded in its header page.
+type KeyMode byte
+
+const (
+	// KeyModeDefault uses the mode recorded in an existing database, or
+	// KeyModeHMAC for a new one.
+	KeyModeDefault KeyMode = 0x00
+	// KeyModeHMAC stores the HMAC-SHA256 of each key. Keys are confidential
+	// but the tree order is unrelated to the original keys, so only full
+	// scans are possible.
+	KeyModeHMAC KeyMode = 0x01
+	// KeyModePlain stores keys as given. Range and prefix scans follow the
+	// byte order of the keys. Use it when keys need ordered scans and need
+	// not stay confidential.
+	KeyModePlain KeyMode = 0x02
+)
+
+// ErrKeyModeMismatch is returned when a database is opened with a key mode
+// other than the one it was created with.
+var ErrKeyModeMismatch = errors.New("key mode does not match the database")
+
+// ErrUnorderedKeys is returned for bounded scans on a tree whose keys are
+// stored in KeyModeHMAC.
+var ErrUnorderedKeys = errors.New("keys are not stored in order")
+
+// supported reports whether keys can be stored in the key mode.
+func (m KeyMode) supported() bool {
+	return m == KeyModeHMAC || m == KeyModePlain
+}
+
+// String returns the name of the key mode.
+func (m KeyMode) String() string {
+	switch m {
+	case KeyModeDefault:
+		return "default"
+	case KeyModeHMAC:
+		return "hmac"
+	case KeyModePlain:
+		return "plain"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(m))
+	}
+}
+
+// indexKey returns the form a key is stored under in the tree.
+func (b *BTree) indexKey(key string) string {
+	return b.indexKeyWith(b.currentHMACKey(), key)
+}
+
+// indexKeyWith returns the form a key is stored under with the given HMAC key.
+func (b *BTree) indexKeyWith(hmacKey []byte, key string) string {
+	switch b.keyMode {
+	case KeyModePlain:
+		return key
+	default:
+		return b.hashKey(hmacKey, key)
+	}
+}
+
+// prefixEnd returns the smallest string greater than every string starting
+// with prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
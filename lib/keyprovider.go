@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeySet is the key material a BTree is opened with. The tree keeps its own
+// copy and zeroes it on Shutdown.
+type KeySet struct {
+	HMACKey       []byte // Key the stored form of keys is derived from, see KeyMode
+	EncryptionKey []byte // 32-byte key values and key names are sealed with
+	Nonce         []byte // Shared nonce of values imported from v1.2.4, see Migrate; nil if none
+
+	// Keys rotated out by a rotation that had not finished when the
+	// database was closed, nil if none. The database records whether one is
+	// in progress, and an open with other keys fails with ErrKeyMismatch.
+	// The rotation resumes when the tree is opened, see RotateEncryptionKey
+	// and RotateHMACKey.
+	PreviousHMACKey       []byte
+	PreviousEncryptionKey []byte
+}
+
+// Zero overwrites the key material with zeros.
+func (k *KeySet) Zero() {
+	for _, key := range [][]byte{k.HMACKey, k.EncryptionKey, k.Nonce, k.PreviousHMACKey, k.PreviousEncryptionKey} {
+		clear(key)
+	}
+}
+
+// clone returns a copy of the key set that shares no memory with it.
+func (k *KeySet) clone() *KeySet {
+	return &KeySet{
+		HMACKey:               bytes.Clone(k.HMACKey),
+		EncryptionKey:         bytes.Clone(k.EncryptionKey),
+		Nonce:                 bytes.Clone(k.Nonce),
+		PreviousHMACKey:       bytes.Clone(k.PreviousHMACKey),
+		PreviousEncryptionKey: bytes.Clone(k.PreviousEncryptionKey),
+	}
+}
+
+// zeroKeys overwrites every key held by the tree with zeros.
+func (b *BTree) zeroKeys() {
+	clear(b.hmacKey)
+	clear(b.encryptionKey)
+	clear(b.legacyNonce)
+	if r := b.rotation.Load(); r != nil {
+		clear(r.oldKey)
+		clear(r.newKey)
+	}
+	if r := b.hmacRotation.Load(); r != nil {
+		clear(r.oldKey)
+		clear(r.newKey)
+	}
+}
+
+// KeyProvider supplies the keys of a BTree. LoadKeys is called once when the
+// tree is opened, and the caller owns the returned key set.
+type KeyProvider interface {
+	LoadKeys() (*KeySet, error)
+}
+
+// StaticKeyProvider returns keys held in memory.
+type StaticKeyProvider struct {
+	Keys KeySet
+}
+
+// StaticKeys returns a provider for raw keys. nonce may be nil.
+func StaticKeys(hmacKey, encryptionKey, nonce []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{Keys: KeySet{HMACKey: hmacKey, EncryptionKey: encryptionKey, Nonce: nonce}}
+}
+
+// LoadKeys returns a copy of the keys.
+func (p *StaticKeyProvider) LoadKeys() (*KeySet, error) {
+	return p.Keys.clone(), nil
+}
+
+// Key files, and the output of key commands, hold one key per line as a name,
+// an equals sign and the key in hex. Empty lines and lines starting with # are
+// ignored. The names are:
+//
+//	hmac                 KeySet.HMACKey
+//	encryption           KeySet.EncryptionKey
+//	nonce                KeySet.Nonce
+//	previous_hmac        KeySet.PreviousHMACKey
+//	previous_encryption  KeySet.PreviousEncryptionKey
+var keyFileNames = []string{"hmac", "encryption", "nonce", "previous_hmac", "previous_encryption"}
+
+// field returns the key of the key set stored under a key file name.
+func (k *KeySet) field(name string) *[]byte {
+	switch name {
+	case "hmac":
+		return &k.HMACKey
+	case "encryption":
+		return &k.EncryptionKey
+	case "nonce":
+		return &k.Nonce
+	case "previous_hmac":
+		return &k.PreviousHMACKey
+	case "previous_encryption":
+		return &k.PreviousEncryptionKey
+	}
+	return nil
+}
+
+// parseKeyFile parses key material in the key file format.
+func parseKeyFile(data []byte) (*KeySet, error) {
+	keys := &KeySet{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			keys.Zero()
+			return nil, fmt.Errorf("line %d: expected name=hex", n)
+		}
+		field := keys.field(strings.TrimSpace(name))
+		if field == nil {
+			keys.Zero()
+			return nil, fmt.Errorf("line %d: unknown key %q", n, strings.TrimSpace(name))
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			keys.Zero()
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		*field = key
+	}
+	if err := scanner.Err(); err != nil {
+		keys.Zero()
+		return nil, err
+	}
+	return keys, nil
+}
+
+// FormatKeyFile returns key material in the key file format.
+func FormatKeyFile(keys *KeySet) []byte {
+	var buf bytes.Buffer
+	for _, name := range keyFileNames {
+		if key := *keys.field(name); key != nil {
+			fmt.Fprintf(&buf, "%s=%x\n", name, key)
+		}
+	}
+	return buf.Bytes()
+}
+
+// FileKeyProvider reads keys from a key file.
+type FileKeyProvider struct {
+	Path string
+}
+
+// LoadKeys reads and parses the key file. It refuses files that can be read
+// by other users.
+func (p *FileKeyProvider) LoadKeys() (*KeySet, error) {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("key file %s is accessible by other users (mode %v)", p.Path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(data)
+
+	keys, err := parseKeyFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", p.Path, err)
+	}
+	return keys, nil
+}
+
+// EnvKeyProvider reads hex-encoded keys from environment variables named
+// after the key file names in upper case, with Prefix in front, for example
+// KAYVEEDB_HMAC and KAYVEEDB_ENCRYPTION.
+type EnvKeyProvider struct {
+	Prefix string // Variable name prefix, "KAYVEEDB_" if empty
+}
+
+// LoadKeys reads the keys from the environment. Unset variables leave their key nil.
+func (p *EnvKeyProvider) LoadKeys() (*KeySet, error) {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = "KAYVEEDB_"
+	}
+
+	keys := &KeySet{}
+	for _, name := range keyFileNames {
+		variable := prefix + strings.ToUpper(name)
+		value, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			keys.Zero()
+			return nil, fmt.Errorf("%s: %w", variable, err)
+		}
+		*keys.field(name) = key
+	}
+	return keys, nil
+}
+
+// DefaultKeyCommandTimeout is how long a CommandKeyProvider waits for its
+// command when no timeout is given.
+const DefaultKeyCommandTimeout = 10 * time.Second
+
+// CommandKeyProvider runs an external command, such as a secrets manager
+// client, and reads keys in the key file format from its standard output.
+type CommandKeyProvider struct {
+	Name    string
+	Args    []string
+	Timeout time.Duration // Zero selects DefaultKeyCommandTimeout
+}
+
+// LoadKeys runs the command and parses its output.
+func (p *CommandKeyProvider) LoadKeys() (*KeySet, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultKeyCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Name, p.Args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	defer clear(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("key command %s failed: %w: %s", p.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	keys, err := parseKeyFile(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("key command %s: %w", p.Name, err)
+	}
+	return keys, nil
+}
+
+// KeyUnwrapper decrypts data keys wrapped by a key management service.
+type KeyUnwrapper interface {
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// EnvelopeKeyProvider implements envelope encryption: Source supplies keys
+// wrapped by a key management service, and Unwrapper decrypts them. Only the
+// wrapped keys are stored next to the database.
+type EnvelopeKeyProvider struct {
+	Source    KeyProvider
+	Unwrapper KeyUnwrapper
+}
+
+// LoadKeys loads the wrapped keys from Source and unwraps each of them.
+func (p *EnvelopeKeyProvider) LoadKeys() (*KeySet, error) {
+	wrapped, err := p.Source.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapped.Zero()
+
+	keys := &KeySet{}
+	for _, name := range keyFileNames {
+		w := *wrapped.field(name)
+		if w == nil {
+			continue
+		}
+		key, err := p.Unwrapper.UnwrapKey(w)
+		if err != nil {
+			keys.Zero()
+			return nil, fmt.Errorf("failed to unwrap %s key: %w", name, err)
+		}
+		*keys.field(name) = key
+	}
+	return keys, nil
+}
+
+// LocalKMS is a local stand-in for a key management service. It wraps data
+// keys with a master key kept in its own file, so that the master key can be
+// stored apart from the wrapped keys and the database.
+type LocalKMS struct {
+	masterKey []byte
+}
+
+// localKMSContext is bound to every wrapped key as associated data.
+var localKMSContext = []byte("kayveedb local kms data key")
+
+// OpenLocalKMS opens the master key file at path, creating it with a new
+// random master key if it does not exist. Like FileKeyProvider, it refuses a
+// file that can be read by other users.
+func OpenLocalKMS(path string) (*LocalKMS, error) {
+	var masterKey []byte
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		masterKey = make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(masterKey); err != nil {
+			return nil, fmt.Errorf("failed to generate master key: %w", err)
+		}
+		if err := os.WriteFile(path, masterKey, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write master key: %w", err)
+		}
+	case err != nil:
+		return nil, err
+	case info.Mode().Perm()&0o077 != 0:
+		return nil, fmt.Errorf("master key file %s is accessible by other users (mode %v)", path, info.Mode().Perm())
+	default:
+		if masterKey, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(masterKey) != chacha20poly1305.KeySize {
+		clear(masterKey)
+		return nil, fmt.Errorf("master key in %s must be %d bytes", path, chacha20poly1305.KeySize)
+	}
+	return &LocalKMS{masterKey: masterKey}, nil
+}
+
+// GenerateDataKey returns a new random key of the given size and its wrapped form.
+func (k *LocalKMS) GenerateDataKey(size int) (key, wrapped []byte, err error) {
+	key = make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err = k.WrapKey(key)
+	if err != nil {
+		clear(key)
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+// WrapKey encrypts a data key under the master key.
+func (k *LocalKMS) WrapKey(key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(k.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, key, localKMSContext), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey.
+func (k *LocalKMS) UnwrapKey(wrapped []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(k.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, wrapped[:n], wrapped[n:], localKMSContext)
+}
+
+// Close zeroes the master key.
+func (k *LocalKMS) Close() {
+	clear(k.masterKey)
+}
@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testKeySet returns a key set with every key set.
+func testKeySet() *KeySet {
+	return &KeySet{
+		HMACKey:               bytes.Repeat([]byte{0x11}, 32),
+		EncryptionKey:         bytes.Repeat([]byte{0x22}, 32),
+		Nonce:                 bytes.Repeat([]byte{0x33}, 24),
+		PreviousHMACKey:       bytes.Repeat([]byte{0x44}, 32),
+		PreviousEncryptionKey: bytes.Repeat([]byte{0x55}, 32),
+	}
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	p := StaticKeys(testHMACKey, testEncryptionKey, nil)
+	keys, err := p.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.HMACKey, testHMACKey) || !bytes.Equal(keys.EncryptionKey, testEncryptionKey) || keys.Nonce != nil {
+		t.Fatalf("loaded %+v", keys)
+	}
+	// The caller owns the returned keys, and may zero them
+	keys.Zero()
+	if !bytes.Equal(p.Keys.HMACKey, testHMACKey) || !bytes.Equal(p.Keys.EncryptionKey, testEncryptionKey) {
+		t.Fatal("zeroing the loaded keys zeroed the provider's")
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	want := testKeySet()
+	data := append([]byte("# test keys\n\n"), FormatKeyFile(want)...)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := &FileKeyProvider{Path: path}
+	keys, err := p.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("loaded %+v, expected %+v", keys, want)
+	}
+
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.LoadKeys(); err == nil {
+		t.Fatal("key file readable by its group was loaded")
+	}
+
+	for _, bad := range []string{"hmac\n", "unknown=00\n", "hmac=xyz\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.LoadKeys(); err == nil {
+			t.Fatalf("key file %q was loaded", bad)
+		}
+	}
+}
+
+func TestEnvKeyProvider(t *testing.T) {
+	t.Setenv("KAYVEEDB_TEST_HMAC", fmt.Sprintf("%x", testHMACKey))
+	t.Setenv("KAYVEEDB_TEST_ENCRYPTION", fmt.Sprintf(" %x\n", testEncryptionKey))
+	p := &EnvKeyProvider{Prefix: "KAYVEEDB_TEST_"}
+	keys, err := p.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &KeySet{HMACKey: testHMACKey, EncryptionKey: testEncryptionKey}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("loaded %+v, expected %+v", keys, want)
+	}
+
+	t.Setenv("KAYVEEDB_TEST_NONCE", "not hex")
+	if _, err := p.LoadKeys(); err == nil {
+		t.Fatal("invalid hex was loaded")
+	}
+}
+
+func TestCommandKeyProvider(t *testing.T) {
+	want := testKeySet()
+	p := &CommandKeyProvider{Name: "sh", Args: []string{"-c", fmt.Sprintf("printf '%s'", FormatKeyFile(want))}}
+	keys, err := p.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("loaded %+v, expected %+v", keys, want)
+	}
+
+	failing := map[string]*CommandKeyProvider{
+		"exit status": {Name: "sh", Args: []string{"-c", "echo no keys >&2; exit 3"}},
+		"bad output":  {Name: "sh", Args: []string{"-c", "echo hmac"}},
+		"timeout":     {Name: "sleep", Args: []string{"10"}, Timeout: 50 * time.Millisecond},
+	}
+	for name, p := range failing {
+		if _, err := p.LoadKeys(); err == nil {
+			t.Fatalf("%s: keys were loaded", name)
+		}
+	}
+}
+
+// TestEnvelopeKeyProvider unwraps keys wrapped by a LocalKMS, whose master key
+// file is created on first use.
+func TestEnvelopeKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	kms, err := OpenLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testKeySet()
+	wrapped := &KeySet{}
+	for _, name := range keyFileNames {
+		w, err := kms.WrapKey(*want.field(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		*wrapped.field(name) = w
+	}
+	kms.Close()
+
+	// The master key is read back from its file
+	kms, err = OpenLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kms.Close()
+	p := &EnvelopeKeyProvider{Source: &StaticKeyProvider{Keys: *wrapped}, Unwrapper: kms}
+	keys, err := p.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("loaded %+v, expected %+v", keys, want)
+	}
+
+	wrapped.EncryptionKey[len(wrapped.EncryptionKey)-1] ^= 1
+	if _, err := p.LoadKeys(); err == nil {
+		t.Fatal("damaged wrapped key was unwrapped")
+	}
+}
+
+func TestLocalKMS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	kms, err := OpenLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("master key file created with %v, %v", info.Mode().Perm(), err)
+	}
+	key, wrapped, err := kms.GenerateDataKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped, err := kms.UnwrapKey(wrapped); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unwrapped %x, %v", unwrapped, err)
+	}
+	if _, err := kms.UnwrapKey(wrapped[:10]); err == nil {
+		t.Fatal("truncated wrapped key was unwrapped")
+	}
+	kms.Close()
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLocalKMS(path); err == nil {
+		t.Fatal("master key file readable by others was opened")
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLocalKMS(path); err == nil {
+		t.Fatal("master key of the wrong size was opened")
+	}
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Every record in the operation log is framed as follows, all integers big
+// endian:
+//
+//	offset  size  field
+//	0       4     payload length in bytes
+//	4       4     CRC-32C (Castagnoli) of the LSN, timestamp and payload
+//	8       8     LSN, one more than the previous record's
+//	16      8     timestamp, Unix nanoseconds
+//	24      n     payload, the encoded operation, see codec.go
+//
+// A record is only valid if it is complete, its checksum matches and its LSN
+// follows the previous one. Replay stops at the first record that is not, so a
+// torn write at the tail of the log loses only the operation being written.
+const (
+	logRecordHeaderSize = 24
+	maxLogRecordSize    = 1 << 28
+)
+
+// ErrCorruptLogRecord is reported when a log record fails validation.
+var ErrCorruptLogRecord = errors.New("corrupt log record")
+
+// RecoveryInfo describes the last replay of the operation log.
+type RecoveryInfo struct {
+	Replayed int    // Records applied to the tree
+	LastLSN  uint64 // LSN of the last valid record in the log
+	Offset   int64  // Offset of the first invalid record, or the log size when there was none
+	Skipped  int64  // Bytes discarded from Offset to the end of the log
+	Err      error  // Why replay stopped before the end of the log, nil if it did not
+}
+
+// encodeLogRecord frames a log entry for appending to the log.
+func encodeLogRecord(entry LogEntry) ([]byte, error) {
+	data := appendLogPayload(make([]byte, logRecordHeaderSize, logRecordHeaderSize+64+len(entry.Key)+len(entry.Value)), entry)
+	if len(data)-logRecordHeaderSize > maxLogRecordSize {
+		return nil, fmt.Errorf("log record of %d bytes exceeds %d", len(data)-logRecordHeaderSize, maxLogRecordSize)
+	}
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-logRecordHeaderSize))
+	binary.BigEndian.PutUint64(data[8:16], entry.LSN)
+	binary.BigEndian.PutUint64(data[16:24], uint64(entry.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(data[4:8], crc32.Checksum(data[8:], crcTable))
+	return data, nil
+}
+
+// readLogRecord reads the next record from the log and returns it with its
+// size in bytes. It returns io.EOF at the end of the
+// log and an error wrapping ErrCorruptLogRecord for a torn or damaged record.
+func readLogRecord(r *bufio.Reader) (LogEntry, int64, error) {
+	header := make([]byte, logRecordHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return LogEntry{}, 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return LogEntry{}, 0, fmt.Errorf("%w: torn header of %d bytes", ErrCorruptLogRecord, n)
+		}
+		return LogEntry{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxLogRecordSize {
+		return LogEntry{}, 0, fmt.Errorf("%w: payload length %d", ErrCorruptLogRecord, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return LogEntry{}, 0, fmt.Errorf("%w: torn payload", ErrCorruptLogRecord)
+		}
+		return LogEntry{}, 0, err
+	}
+
+	sum := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, payload)
+	if sum != binary.BigEndian.Uint32(header[4:8]) {
+		return LogEntry{}, 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptLogRecord)
+	}
+
+	entry, err := decodeLogPayload(payload)
+	if err != nil {
+		return LogEntry{}, 0, fmt.Errorf("%w: %v", ErrCorruptLogRecord, err)
+	}
+	entry.LSN = binary.BigEndian.Uint64(header[8:16])
+	entry.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(header[16:24])))
+	return entry, logRecordHeaderSize + int64(length), nil
+}
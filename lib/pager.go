@@ -0,0 +1,575 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The database file is divided into fixed-size pages. Page 0 is the header
+// page and records the file magic, the page size and the file header, see
+// fileHeader. Pages 1 and 2 hold two
+// copies of the superblock, which points at the committed root node and the
+// committed free list. Every page starts with a small page header:
+//
+//	offset  size  field
+//	0       1     page type
+//	1       3     reserved
+//	4       4     payload length in bytes
+//	8       8     next page id (overflow chain or free list chain), 0 if none
+//
+// A node lives in its first page and, when its encoding does not fit in a
+// single page, in a chain of overflow pages linked through "next".
+//
+// The tree is copy-on-write. Pages reachable from the committed superblock are
+// never modified: a changed node is written to a newly allocated page, and the
+// pages it replaces only become reusable once the next superblock is durable.
+// A commit writes every changed node and the free list, syncs the file, then
+// writes the superblock with the next generation number into the slot not
+// holding the current one and syncs again. On open the valid superblock with
+// the highest generation wins, so a crash at any point leaves the last fully
+// committed tree in place.
+const (
+	pageSize        = 4096
+	pageHeaderSize  = 16
+	pagePayloadSize = pageSize - pageHeaderSize
+)
+
+// Page types stored in the first byte of every page.
+const (
+	pageTypeHeader     byte = 0x01
+	pageTypeNode       byte = 0x02
+	pageTypeOverflow   byte = 0x03
+	pageTypeSuperblock byte = 0x04
+	pageTypeFreelist   byte = 0x05
+)
+
+// Fixed page ids.
+const (
+	headerPage     uint64 = 0
+	superblockPage uint64 = 1 // Superblocks occupy pages 1 and 2
+	firstDataPage  uint64 = 3
+)
+
+// superblockSize is the encoded size of a superblock: magic, generation,
+// root, free list, page count, checkpoint LSN, the four key IDs of the key
+// state and a trailing CRC-32C checksum.
+const superblockSize = 8 + 8*5 + 4*4 + 4
+
+// dbMagic identifies a kayveedb page file.
+var dbMagic = [8]byte{'K', 'A', 'Y', 'V', 'E', 'E', 'D', 'B'}
+
+// crcTable is the Castagnoli table used for page checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptPage is returned when a page does not have the expected layout.
+var ErrCorruptPage = errors.New("corrupt database page")
+
+// superblock is the commit record of the tree.
+type superblock struct {
+	generation uint64   // Incremented on every commit
+	root       uint64   // Page id of the root node, 0 if the tree has not been written yet
+	freelist   uint64   // First page of the free list chain, 0 if none
+	pageCount  uint64   // Number of pages in use, including the header and superblocks
+	lsn        uint64   // Last log record reflected in the tree, see Checkpoint
+	keys       keyState // Keys the tree is sealed and indexed with
+}
+
+// pager manages page allocation and page I/O on the database file.
+type pager struct {
+	file      *os.File
+	header    fileHeader          // Header recorded in the header page
+	meta      superblock          // Last committed superblock
+	pageCount atomic.Uint64       // Number of pages in the file, including uncommitted ones
+	free      []uint64            // Pages available for allocation
+	pending   []uint64            // Pages released since the last commit, reusable after it
+	txnPages  map[uint64]struct{} // Pages allocated since the last commit
+	pinned    bool                // Set while a snapshot is being read, see pin
+	held      []uint64            // Pages released while pinned, kept out of reuse until unpin
+	mu        sync.Mutex
+}
+
+// newPager opens the page file, writing a fresh header and superblocks if the
+// file is empty. header is recorded in a new file, with the current format
+// version. A file that is no longer than its fixed pages and has no valid
+// header or superblock was torn while it was being created; as nothing was
+// committed to it yet, it is set up again like an empty one.
+func newPager(file *os.File, header fileHeader) (*pager, error) {
+	p := &pager{file: file, header: header, txnPages: make(map[uint64]struct{})}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat database file: %w", err)
+	}
+	if info.Size() == 0 {
+		if err := p.create(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	err = p.readHeader()
+	if err == nil {
+		err = p.readSuperblock()
+	}
+	if err != nil {
+		if info.Size() <= int64(firstDataPage)*pageSize {
+			p.header = header
+			if err := p.create(); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}
+		return nil, err
+	}
+	if err := p.readFreelist(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// create writes the header page and both superblocks of a new file.
+func (p *pager) create() error {
+	p.header.version = dbFormatVersion
+	p.meta = superblock{pageCount: firstDataPage}
+	p.pageCount.Store(firstDataPage)
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+	for i := uint64(0); i < 2; i++ {
+		if err := p.writeSuperblock(superblockPage+i, p.meta); err != nil {
+			return err
+		}
+	}
+	return p.file.Sync()
+}
+
+// readHeader validates the header page and loads the file header.
+func (p *pager) readHeader() error {
+	buf := make([]byte, pageSize)
+	if _, err := p.file.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("failed to read header page: %w", err)
+	}
+	header, err := decodeHeaderPage(buf)
+	if err != nil {
+		return err
+	}
+	p.header = header
+	return nil
+}
+
+// decodeHeaderPage returns the file header recorded in a header page.
+func decodeHeaderPage(buf []byte) (fileHeader, error) {
+	if buf[0] != pageTypeHeader || string(buf[pageHeaderSize:pageHeaderSize+8]) != string(dbMagic[:]) {
+		return fileHeader{}, fmt.Errorf("%w: not a kayveedb database file", ErrCorruptPage)
+	}
+	payload := buf[pageHeaderSize:]
+	if size := binary.BigEndian.Uint32(payload[8:]); size != pageSize {
+		return fileHeader{}, fmt.Errorf("%w: unsupported page size %d", ErrCorruptPage, size)
+	}
+
+	header := fileHeader{
+		keyMode: KeyMode(payload[12]),
+		suite:   CipherSuite(payload[13]),
+		version: binary.BigEndian.Uint16(payload[14:16]),
+		t:       int(binary.BigEndian.Uint32(payload[16:20])),
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(payload[20:28]))),
+	}
+	return header, nil
+}
+
+// writeHeader writes the header page.
+func (p *pager) writeHeader() error {
+	payload := make([]byte, 8+4+1+1+2+4+8)
+	copy(payload[0:8], dbMagic[:])
+	binary.BigEndian.PutUint32(payload[8:12], pageSize)
+	payload[12] = byte(p.header.keyMode)
+	payload[13] = byte(p.header.suite)
+	binary.BigEndian.PutUint16(payload[14:16], p.header.version)
+	binary.BigEndian.PutUint32(payload[16:20], uint32(p.header.t))
+	binary.BigEndian.PutUint64(payload[20:28], uint64(p.header.created.UnixNano()))
+	return p.writePage(headerPage, pageTypeHeader, 0, payload)
+}
+
+// readSuperblock loads the newest valid superblock.
+func (p *pager) readSuperblock() error {
+	found := false
+	for i := uint64(0); i < 2; i++ {
+		sb, err := p.decodeSuperblock(superblockPage + i)
+		if err != nil {
+			continue
+		}
+		if !found || sb.generation > p.meta.generation {
+			p.meta = sb
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: no valid superblock", ErrCorruptPage)
+	}
+	p.pageCount.Store(p.meta.pageCount)
+	return nil
+}
+
+// decodeSuperblock reads and verifies the superblock stored in the given page.
+func (p *pager) decodeSuperblock(id uint64) (superblock, error) {
+	buf := make([]byte, pageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*pageSize); err != nil {
+		return superblock{}, err
+	}
+	payload := buf[pageHeaderSize : pageHeaderSize+superblockSize]
+	if buf[0] != pageTypeSuperblock || string(payload[0:8]) != string(dbMagic[:]) {
+		return superblock{}, ErrCorruptPage
+	}
+	sum := binary.BigEndian.Uint32(payload[superblockSize-4:])
+	if crc32.Checksum(payload[:superblockSize-4], crcTable) != sum {
+		return superblock{}, ErrCorruptPage
+	}
+	return superblock{
+		generation: binary.BigEndian.Uint64(payload[8:16]),
+		root:       binary.BigEndian.Uint64(payload[16:24]),
+		freelist:   binary.BigEndian.Uint64(payload[24:32]),
+		pageCount:  binary.BigEndian.Uint64(payload[32:40]),
+		lsn:        binary.BigEndian.Uint64(payload[40:48]),
+		keys: keyState{
+			encryption:         binary.BigEndian.Uint32(payload[48:52]),
+			previousEncryption: binary.BigEndian.Uint32(payload[52:56]),
+			hmac:               binary.BigEndian.Uint32(payload[56:60]),
+			previousHMAC:       binary.BigEndian.Uint32(payload[60:64]),
+		},
+	}, nil
+}
+
+// writeSuperblock writes a checksummed superblock into the given page.
+func (p *pager) writeSuperblock(id uint64, sb superblock) error {
+	payload := make([]byte, superblockSize)
+	copy(payload[0:8], dbMagic[:])
+	binary.BigEndian.PutUint64(payload[8:16], sb.generation)
+	binary.BigEndian.PutUint64(payload[16:24], sb.root)
+	binary.BigEndian.PutUint64(payload[24:32], sb.freelist)
+	binary.BigEndian.PutUint64(payload[32:40], sb.pageCount)
+	binary.BigEndian.PutUint64(payload[40:48], sb.lsn)
+	binary.BigEndian.PutUint32(payload[48:52], sb.keys.encryption)
+	binary.BigEndian.PutUint32(payload[52:56], sb.keys.previousEncryption)
+	binary.BigEndian.PutUint32(payload[56:60], sb.keys.hmac)
+	binary.BigEndian.PutUint32(payload[60:64], sb.keys.previousHMAC)
+	binary.BigEndian.PutUint32(payload[superblockSize-4:], crc32.Checksum(payload[:superblockSize-4], crcTable))
+	return p.writePage(id, pageTypeSuperblock, 0, payload)
+}
+
+// readFreelist loads the committed free list.
+func (p *pager) readFreelist() error {
+	p.free = nil
+	for id, n := p.meta.freelist, uint64(0); id != 0; n++ {
+		typ, next, payload, err := p.readPage(id)
+		if err != nil {
+			return err
+		}
+		if typ != pageTypeFreelist || n > p.pageCount.Load() {
+			return fmt.Errorf("%w: bad free list page %d", ErrCorruptPage, id)
+		}
+		for i := 0; i+8 <= len(payload); i += 8 {
+			p.free = append(p.free, binary.BigEndian.Uint64(payload[i:]))
+		}
+		// The free list pages themselves are released once a newer list is committed
+		p.pending = append(p.pending, id)
+		id = next
+	}
+	return nil
+}
+
+// readPage reads a page and returns its type, next pointer and payload.
+func (p *pager) readPage(id uint64) (byte, uint64, []byte, error) {
+	if id < firstDataPage || id >= p.pageCount.Load() {
+		return 0, 0, nil, fmt.Errorf("%w: page %d out of range", ErrCorruptPage, id)
+	}
+
+	buf := make([]byte, pageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*pageSize); err != nil && err != io.EOF {
+		return 0, 0, nil, fmt.Errorf("failed to read page %d: %w", id, err)
+	}
+
+	length := binary.BigEndian.Uint32(buf[4:8])
+	if length > pagePayloadSize {
+		return 0, 0, nil, fmt.Errorf("%w: page %d payload length %d", ErrCorruptPage, id, length)
+	}
+	next := binary.BigEndian.Uint64(buf[8:16])
+	return buf[0], next, buf[pageHeaderSize : pageHeaderSize+length], nil
+}
+
+// writePage writes a full page with the given type, next pointer and payload.
+func (p *pager) writePage(id uint64, typ byte, next uint64, payload []byte) error {
+	if len(payload) > pagePayloadSize {
+		return fmt.Errorf("page payload of %d bytes exceeds %d", len(payload), pagePayloadSize)
+	}
+
+	buf := make([]byte, pageSize)
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint64(buf[8:16], next)
+	copy(buf[pageHeaderSize:], payload)
+
+	if _, err := p.file.WriteAt(buf, int64(id)*pageSize); err != nil {
+		return fmt.Errorf("failed to write page %d: %w", id, err)
+	}
+	return nil
+}
+
+// allocate returns a page that is not part of the committed tree, taking it
+// from the free list when possible and extending the file otherwise.
+func (p *pager) allocate() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.allocateLocked()
+}
+
+func (p *pager) allocateLocked() uint64 {
+	var id uint64
+	if n := len(p.free); n > 0 {
+		id = p.free[n-1]
+		p.free = p.free[:n-1]
+	} else {
+		id = p.pageCount.Add(1) - 1
+	}
+	p.txnPages[id] = struct{}{}
+	return id
+}
+
+// isWritable reports whether a page was allocated since the last commit and
+// may therefore be overwritten in place.
+func (p *pager) isWritable(id uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.txnPages[id]
+	return ok
+}
+
+// release gives pages back to the pager. Pages allocated since the last
+// commit are reusable immediately; committed pages are still referenced by
+// the current superblock and only become reusable after the next commit.
+func (p *pager) release(ids ...uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releaseLocked(ids...)
+}
+
+func (p *pager) releaseLocked(ids ...uint64) {
+	for _, id := range ids {
+		if _, ok := p.txnPages[id]; ok {
+			delete(p.txnPages, id)
+			p.free = append(p.free, id)
+		} else {
+			p.pending = append(p.pending, id)
+		}
+	}
+}
+
+// readChain reads the node stored at the given first page and returns its
+// bytes together with the ids of every page in the chain.
+func (p *pager) readChain(first uint64) ([]byte, []uint64, error) {
+	var data []byte
+	var pages []uint64
+
+	for id := first; id != 0; {
+		typ, next, payload, err := p.readPage(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		want := pageTypeOverflow
+		if id == first {
+			want = pageTypeNode
+		}
+		if typ != want {
+			return nil, nil, fmt.Errorf("%w: page %d has type %d, expected %d", ErrCorruptPage, id, typ, want)
+		}
+		if uint64(len(pages)) > p.pageCount.Load() {
+			return nil, nil, fmt.Errorf("%w: overflow chain at page %d loops", ErrCorruptPage, first)
+		}
+		data = append(data, payload...)
+		pages = append(pages, id)
+		id = next
+	}
+	return data, pages, nil
+}
+
+// writeChain writes data over the given page chain, growing the chain with
+// newly allocated pages or releasing surplus pages as needed. Every page in
+// the chain must have been allocated since the last commit. It returns the
+// chain now holding the data.
+func (p *pager) writeChain(pages []uint64, data []byte) ([]uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	needed := (len(data) + pagePayloadSize - 1) / pagePayloadSize
+	if needed == 0 {
+		needed = 1
+	}
+
+	chain := append([]uint64{}, pages...)
+	for len(chain) < needed {
+		chain = append(chain, p.allocateLocked())
+	}
+	if len(chain) > needed {
+		p.releaseLocked(chain[needed:]...)
+		chain = chain[:needed]
+	}
+
+	for i, id := range chain {
+		if _, ok := p.txnPages[id]; !ok {
+			return nil, fmt.Errorf("refusing to overwrite committed page %d", id)
+		}
+		start := i * pagePayloadSize
+		end := min(start+pagePayloadSize, len(data))
+
+		typ := pageTypeOverflow
+		if i == 0 {
+			typ = pageTypeNode
+		}
+		var next uint64
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+		if err := p.writePage(id, typ, next, data[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+// commit makes every page written since the last commit durable and
+// atomically switches the superblock to the given root page. lsn is the last
+// log record the committed tree reflects, and keys the keys it is sealed and
+// indexed with.
+func (p *pager) commit(root, lsn uint64, keys keyState) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Pick the pages holding the new free list. They come from pages that are
+	// already free, so the committed tree is untouched, and the file is only
+	// extended when there are not enough of them.
+	perPage := pagePayloadSize / 8
+	total := len(p.free) + len(p.pending)
+	count := 0
+	for count*perPage < total-count {
+		count++
+	}
+	listPages := make([]uint64, 0, count)
+	for len(listPages) < count {
+		if n := len(p.free); n > 0 {
+			listPages = append(listPages, p.free[n-1])
+			p.free = p.free[:n-1]
+		} else {
+			listPages = append(listPages, p.pageCount.Add(1)-1)
+		}
+	}
+	defer func() {
+		// A failed commit leaves the transaction open; the list pages are
+		// picked again by the next attempt
+		if err != nil {
+			p.free = append(p.free, listPages...)
+		}
+	}()
+
+	// Everything released in this transaction is free once the new superblock
+	// is in place, unless a snapshot reader still needs it
+	free := append(append(append([]uint64{}, p.free...), p.held...), p.pending...)
+
+	for i, id := range listPages {
+		chunk := free[min(i*perPage, len(free)):min((i+1)*perPage, len(free))]
+		payload := make([]byte, 8*len(chunk))
+		for j, freeID := range chunk {
+			binary.BigEndian.PutUint64(payload[8*j:], freeID)
+		}
+		var next uint64
+		if i+1 < len(listPages) {
+			next = listPages[i+1]
+		}
+		if err := p.writePage(id, pageTypeFreelist, next, payload); err != nil {
+			return err
+		}
+	}
+	var freelist uint64
+	if len(listPages) > 0 {
+		freelist = listPages[0]
+	}
+
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database file: %w", err)
+	}
+
+	sb := superblock{
+		generation: p.meta.generation + 1,
+		root:       root,
+		freelist:   freelist,
+		pageCount:  p.pageCount.Load(),
+		lsn:        lsn,
+		keys:       keys,
+	}
+	if err := p.writeSuperblock(superblockPage+sb.generation%2, sb); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync superblock: %w", err)
+	}
+
+	p.meta = sb
+	if p.pinned {
+		p.held = append(p.held, p.pending...)
+	} else {
+		p.free = free
+	}
+	p.pending = listPages
+	p.txnPages = make(map[uint64]struct{})
+	return nil
+}
+
+// rollback discards every allocation and release made since the last commit.
+func (p *pager) rollback() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pageCount.Store(p.meta.pageCount)
+	p.pending = nil
+	p.txnPages = make(map[uint64]struct{})
+	if err := p.readFreelist(); err != nil {
+		return err
+	}
+
+	// The committed free list includes held pages; keep them out of reuse
+	if len(p.held) > 0 {
+		held := make(map[uint64]struct{}, len(p.held))
+		for _, id := range p.held {
+			held[id] = struct{}{}
+		}
+		p.free = slices.DeleteFunc(p.free, func(id uint64) bool {
+			_, ok := held[id]
+			return ok
+		})
+	}
+	return nil
+}
+
+// pin keeps every page of the committed tree from being reused, so the tree
+// as of this commit can be read without holding the tree lock. Pages
+// released by later commits are held back until unpin.
+func (p *pager) pin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned = true
+}
+
+// unpin makes the pages held back since pin available for reuse.
+func (p *pager) unpin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned = false
+	p.free = append(p.free, p.held...)
+	p.held = nil
+}
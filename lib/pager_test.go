@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTornCreation checks that a database file torn while it was being
+// created opens as a new database.
+func TestTornCreation(t *testing.T) {
+	for _, size := range []int64{1, pageSize - 1, pageSize, 2 * pageSize} {
+		dir := t.TempDir()
+		file, err := os.Create(filepath.Join(dir, "kayvee.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newPager(file, fileHeader{t: 3, keyMode: KeyModeHMAC, suite: CipherSuiteXChaCha20Poly1305}); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Truncate(size); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		b := openTestTree(t, dir, 10, KeyModeHMAC)
+		if err := b.Insert("key", []byte("value")); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		closeTestTree(t, b)
+		b = openTestTree(t, dir, 10, KeyModeHMAC)
+		if value, err := b.Read("key"); err != nil || string(value) != "value" {
+			t.Fatalf("size %d: read %q, %v", size, value, err)
+		}
+		closeTestTree(t, b)
+	}
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PutMode selects whether a Put may insert a new key, replace the value of an
+// existing one, or both. An expired key counts as absent.
+type PutMode int
+
+const (
+	PutUpsert     PutMode = iota // Insert the key, or replace its value if it is present
+	PutInsertOnly                // Only insert a key that is not present
+	PutUpdateOnly                // Only replace the value of a key that is present
+)
+
+func (m PutMode) String() string {
+	switch m {
+	case PutUpsert:
+		return "upsert"
+	case PutInsertOnly:
+		return "insert-only"
+	case PutUpdateOnly:
+		return "update-only"
+	default:
+		return fmt.Sprintf("PutMode(%d)", m)
+	}
+}
+
+// Put writes value under key as selected by mode. A key is stored at most
+// once: replacing a value changes the entry of the key in place, or moves it
+// to its index key under the new HMAC key during a rotation. A replaced key
+// keeps its key name and expiry time. With PutInsertOnly, a present key
+// returns a *ConflictError wrapping ErrKeyExists; with PutUpdateOnly, a
+// missing key is an error. Put returns once the log record is durable.
+func (b *BTree) Put(key string, value []byte, mode PutMode) error {
+	lsn, err := b.applyPut(key, value, putRequest{mode: mode})
+	if err != nil {
+		return err
+	}
+	return b.waitDurable(lsn)
+}
+
+// putRequest holds the conditions and settings of a write made by applyPut.
+type putRequest struct {
+	mode      PutMode
+	check     func(item *KeyValue) error // If set, called with the live entry of the key, nil if there is none; the write is refused if it returns an error
+	expiresAt int64                      // Expiry time of the key after the write, see KeyValue
+	setExpiry bool                       // Whether expiresAt replaces the expiry time of a present key
+}
+
+// applyPut applies a write under the tree lock and returns the LSN of its log record.
+func (b *BTree) applyPut(key string, value []byte, req putRequest) (uint64, error) {
+	if req.mode < PutUpsert || req.mode > PutUpdateOnly {
+		return 0, fmt.Errorf("invalid put mode %s", req.mode)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return 0, b.failed
+	}
+
+	item, at := b.find(key)
+	live := item
+	if live != nil && live.expired(time.Now()) {
+		live = nil
+	}
+	if req.check != nil {
+		if err := req.check(live); err != nil {
+			return 0, err
+		}
+	}
+	switch {
+	case req.mode == PutInsertOnly && live != nil:
+		return 0, &ConflictError{Err: ErrKeyExists, Key: key, Actual: live.Version, Exists: true}
+	case req.mode == PutUpdateOnly && live == nil:
+		return 0, errors.New("key not found")
+	}
+
+	return b.putValue(key, item, at, value, req)
+}
+
+// putValue stores value under key and logs the write, given the entry find
+// returned for the key. It returns the LSN of the log record.
+func (b *BTree) putValue(key string, item *KeyValue, at string, value []byte, req putRequest) (uint64, error) {
+	hKey := b.indexKey(key)
+	encValue, err := b.encrypt(value, b.valueKeys(), hKey)
+	if err != nil {
+		return 0, err
+	}
+
+	kv := &KeyValue{Key: hKey, Value: encValue, ExpiresAt: req.expiresAt, Version: b.nextVersion()}
+	op, err := b.storeEntry(key, item, at, kv, req.setExpiry)
+	if err != nil {
+		return 0, err
+	}
+	return b.commitOp(putEntry(op, key, kv))
+}
+
+// storeEntry writes kv, a new value of key under its current index key, in
+// place of item, the entry find returned for the key, so that the key is never
+// stored twice. A live entry keeps its key name, and its expiry time unless
+// setExpiry is set; an expired entry is replaced. kv is completed with what was
+// stored, and the operation to log it as is returned.
+func (b *BTree) storeEntry(key string, item *KeyValue, at string, kv *KeyValue, setExpiry bool) (string, error) {
+	live := item != nil && !item.expired(time.Now())
+	if live && !setExpiry {
+		kv.ExpiresAt = item.ExpiresAt
+	}
+
+	if live && at == kv.Key {
+		kv.EncryptedKey = item.EncryptedKey
+		_, err := b.modifyKey(b.root, kv.Key, func(stored *KeyValue) error {
+			stored.Value = kv.Value
+			stored.ExpiresAt = kv.ExpiresAt
+			stored.Version = kv.Version
+			return nil
+		})
+		if err != nil {
+			return "", b.abort(err)
+		}
+		return "UPDATE", nil
+	}
+
+	// A new entry, or one moving off the HMAC key being rotated out, whose
+	// key name is bound to its old index key
+	if kv.EncryptedKey == nil && b.keyMode != KeyModePlain {
+		name, err := b.encrypt([]byte(key), b.nameKeys(), kv.Key)
+		if err != nil {
+			return "", err
+		}
+		kv.EncryptedKey = name
+	}
+	if item != nil {
+		if _, err := b.removeKey(at); err != nil {
+			return "", b.abort(err)
+		}
+	}
+	if err := b.insertKV(kv); err != nil {
+		return "", b.abort(err)
+	}
+	if live {
+		return "UPDATE", nil
+	}
+	return "CREATE", nil
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// checkStoredOnce checks that every key is stored under exactly one index key,
+// and that the tree holds nothing else.
+func checkStoredOnce(t *testing.T, b *BTree, keys []string) {
+	t.Helper()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, key := range keys {
+		forms := []string{b.indexKey(key)}
+		if old, ok := b.previousIndexKey(key); ok {
+			forms = append(forms, old)
+		}
+		stored := 0
+		for _, form := range forms {
+			if b.search(b.root, form) != nil {
+				stored++
+			}
+		}
+		if stored != 1 {
+			t.Fatalf("%s is stored %d times", key, stored)
+		}
+	}
+	if count := checkInvariants(t, b); count != len(keys) {
+		t.Fatalf("tree holds %d keys, expected %d", count, len(keys))
+	}
+}
+
+// TestPutModes checks what each put mode does to present, missing and expired
+// keys, and that no mode stores a key twice.
+func TestPutModes(t *testing.T) {
+	b := openTestTree(t, t.TempDir(), 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	if err := b.Put("key", []byte("value"), PutUpdateOnly); err == nil {
+		t.Fatal("update-only put created a key")
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Put("key", []byte(fmt.Sprint("upsert ", i)), PutUpsert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Put("key", []byte("insert"), PutInsertOnly); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("insert-only put of a present key returned %v", err)
+	}
+	if err := b.Put("key", []byte("update"), PutUpdateOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put("key", []byte("value"), PutMode(3)); err == nil {
+		t.Fatal("invalid put mode was accepted")
+	}
+	if value, err := b.Read("key"); err != nil || string(value) != "update" {
+		t.Fatalf("key holds %q, %v", value, err)
+	}
+
+	// An expired key counts as absent, and is replaced
+	if err := b.InsertWithTTL("expired", []byte("value"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := b.Put("expired", []byte("value"), PutUpdateOnly); err == nil {
+		t.Fatal("update-only put replaced an expired key")
+	}
+	if err := b.Put("expired", []byte("new"), PutInsertOnly); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := b.TTL("expired"); err != nil || ttl != NoExpiry {
+		t.Fatalf("replaced key has TTL %v, %v", ttl, err)
+	}
+	checkStoredOnce(t, b, []string{"key", "expired"})
+}
+
+// TestPutDuringReindex checks that puts in every mode leave each key stored
+// once while keys are split between their old and new index keys.
+func TestPutDuringReindex(t *testing.T) {
+	b := openTestTree(t, t.TempDir(), 10, KeyModeHMAC)
+	defer closeTestTree(t, b)
+
+	keys := []string{"alpha", "beta", "gamma"}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		keys = append(keys, key)
+		if err := b.Insert(key, []byte("before")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The sweep stops on a broken value and leaves the rotation in progress,
+	// then every other key is moved by a write
+	rotate(t, b, "hmac", bytes.Repeat([]byte{0x33}, 32), true)
+	for i := 0; i < len(keys); i += 2 {
+		if err := b.Put(keys[i], []byte("moved"), PutUpsert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unmoved := 0
+	b.mu.RLock()
+	for _, key := range keys {
+		if b.search(b.root, b.indexKeyWith(testHMACKey, key)) != nil {
+			unmoved++
+		}
+	}
+	b.mu.RUnlock()
+	if unmoved != len(keys)/2 {
+		t.Fatalf("%d of %d keys are under the old HMAC key, expected %d", unmoved, len(keys), len(keys)/2)
+	}
+
+	for _, key := range keys {
+		if err := b.Put(key, []byte("upsert"), PutUpsert); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(key, []byte("insert"), PutInsertOnly); !errors.Is(err, ErrKeyExists) {
+			t.Fatalf("insert-only put of %s returned %v", key, err)
+		}
+	}
+	checkStoredOnce(t, b, keys)
+	for _, key := range keys {
+		if err := b.Put(key, []byte("update "+key), PutUpdateOnly); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStoredOnce(t, b, keys)
+
+	for _, key := range keys {
+		if value, err := b.Read(key); err != nil || string(value) != "update "+key {
+			t.Fatalf("%s holds %q, %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// The HMAC key decides the index key every key is stored under, see KeyMode.
+// Rotating it moves every entry from its index key under the old HMAC key to
+// the one under the new key. The original key is recovered from the key name
+// recorded with the entry, and the value is sealed again, since it is bound to
+// its index key. While the background sweep runs, new entries go under the new
+// HMAC key and lookups fall back to the old one, so every key stays reachable.
+// Once the sweep has covered every entry, a checkpoint commits the result and
+// the re-indexing finishes.
+//
+// Moving an entry is not logged. The logged operations name keys by their
+// original form, and apply the same way whichever form the key is stored in.
+// Like an encryption key rotation, re-indexing takes a checkpoint when it
+// starts and when it finishes, so the superblock records whether it is in
+// progress. To reopen a database before re-indexing has finished, open it
+// with the new HMAC key as KeySet.HMACKey and the old one as
+// KeySet.PreviousHMACKey; the sweep then resumes.
+
+// ReindexProgress reports the state of the last HMAC key rotation.
+type ReindexProgress struct {
+	Active   bool      // Set from RotateHMACKey until re-indexing finishes
+	Started  time.Time // When re-indexing was started or resumed
+	Finished time.Time // When re-indexing finished, zero while it is active
+	Total    int       // Keys in the tree when the sweep started
+	Scanned  int       // Keys visited by the sweep
+	Moved    int       // Keys moved to their index key under the new HMAC key
+	Err      error     // Why the sweep stopped before finishing, nil if it did not
+}
+
+// hmacRotation is a rotation from one HMAC key to another.
+type hmacRotation struct {
+	oldKey, newKey []byte
+	done           atomic.Bool   // Set when re-indexing has finished
+	stop           chan struct{} // Identifies the running sweep, which stops once it is replaced; nil if none
+
+	// Guarded by BTree.mu
+	progress ReindexProgress
+}
+
+// RotateHMACKey starts moving every key to its index key under newHMACKey and
+// returns once the background sweep is running. The original keys are read
+// from the recorded key names, and moved values are sealed again. Lookups,
+// writes and deletes keep working on every key while the sweep runs; use
+// ReindexProgress to follow it.
+func (b *BTree) RotateHMACKey(newHMACKey []byte) error {
+	if b.keyMode == KeyModePlain {
+		return errors.New("keys are stored in plaintext and do not depend on the HMAC key")
+	}
+	if len(newHMACKey) == 0 {
+		return errors.New("new HMAC key is empty")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return b.failed
+	}
+	if r := b.hmacRotation.Load(); r != nil && !r.done.Load() {
+		return ErrRotationInProgress
+	}
+
+	last := b.hmacRotation.Load()
+	r := &hmacRotation{oldKey: b.currentHMACKey(), newKey: bytes.Clone(newHMACKey)}
+	b.hmacRotation.Store(r)
+	// Record the rotation before anything is indexed with the new key
+	if err := b.checkpoint(); err != nil {
+		b.hmacRotation.Store(last)
+		return err
+	}
+	b.startReindex(r)
+	return nil
+}
+
+// ReindexProgress returns the progress of the current or last HMAC key rotation.
+// It returns false if none was started since the tree was opened.
+func (b *BTree) ReindexProgress() (ReindexProgress, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r := b.hmacRotation.Load()
+	if r == nil {
+		return ReindexProgress{}, false
+	}
+	return r.progress, true
+}
+
+// startReindex starts the sweep of an HMAC key rotation.
+func (b *BTree) startReindex(r *hmacRotation) {
+	r.progress = ReindexProgress{Active: true, Started: time.Now()}
+	r.stop = make(chan struct{})
+	go b.reindexSweep(r, r.stop)
+}
+
+// currentHMACKey returns the HMAC key new entries are indexed under.
+func (b *BTree) currentHMACKey() []byte {
+	if r := b.hmacRotation.Load(); r != nil {
+		return r.newKey
+	}
+	return b.hmacKey
+}
+
+// previousHMACKey returns the HMAC key being rotated out, and false if no
+// rotation is in progress.
+func (b *BTree) previousHMACKey() ([]byte, bool) {
+	r := b.hmacRotation.Load()
+	if r == nil || r.done.Load() {
+		return nil, false
+	}
+	return r.oldKey, true
+}
+
+// previousIndexKey returns the index key of key under the HMAC key being
+// rotated out, and false if no rotation is in progress.
+func (b *BTree) previousIndexKey(key string) (string, bool) {
+	old, ok := b.previousHMACKey()
+	if !ok {
+		return "", false
+	}
+	return b.indexKeyWith(old, key), true
+}
+
+// removePrevious removes the entry of key under the HMAC key being rotated out, if any.
+func (b *BTree) removePrevious(key string) (bool, error) {
+	old, ok := b.previousIndexKey(key)
+	if !ok {
+		return false, nil
+	}
+	return b.removeKey(old)
+}
+
+// reindexSweep moves every entry not yet under the new HMAC key to its index
+// key under it, then finishes the rotation. Moved keys may be visited again
+// further on, and are then already in place.
+func (b *BTree) reindexSweep(r *hmacRotation, stop chan struct{}) {
+	b.runSweep(treeSweep{
+		name:    "Re-indexing",
+		running: func() bool { return r.stop == stop },
+		start:   func(total int) { r.progress.Total = total },
+		visit: func(item KeyValue) (func() error, error) {
+			r.progress.Scanned++
+			kv, err := b.reindex(r, item)
+			if err != nil || kv == nil {
+				return nil, err
+			}
+			return func() error { return b.storeReindexed(r, item.Key, kv) }, nil
+		},
+		settle: func(keys *keyState) { keys.previousHMAC = 0 },
+		finish: func() {
+			r.progress.Active = false
+			r.progress.Finished = time.Now()
+			r.stop = nil
+			r.done.Store(true)
+		},
+		fail: func(err error) {
+			r.progress.Err = err
+			if r.stop == stop {
+				r.stop = nil
+			}
+		},
+	})
+}
+
+// reindex returns the entry item moves to under the new HMAC key of the
+// rotation, with its value sealed again for its new index key, or nil if
+// item is already in place.
+func (b *BTree) reindex(r *hmacRotation, item KeyValue) (*KeyValue, error) {
+	name, err := b.KeyName(item)
+	if err != nil {
+		return nil, fmt.Errorf("cannot re-index %s: %w", item.Key, err)
+	}
+	if b.indexKeyWith(r.newKey, name) == item.Key {
+		return nil, nil
+	}
+	value, err := b.decrypt(item.Value, b.valueKeys(), item.Key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot re-index %s: %w", item.Key, err)
+	}
+	kv, err := b.newKeyValue(name, value)
+	if err != nil {
+		return nil, err
+	}
+	kv.ExpiresAt = item.ExpiresAt
+	kv.Version = item.Version
+	return kv, nil
+}
+
+// storeReindexed moves the entry stored under from to kv.
+func (b *BTree) storeReindexed(r *hmacRotation, from string, kv *KeyValue) error {
+	if _, err := b.removeKey(from); err != nil {
+		return b.abort(err)
+	}
+	// A write during the rotation removes the old entry, so the new one can
+	// only exist already if the same key was stored twice
+	if b.search(b.root, kv.Key) == nil {
+		if err := b.insertKV(kv); err != nil {
+			return b.abort(err)
+		}
+	}
+	r.progress.Moved++
+	b.modCount++
+	return nil
+}
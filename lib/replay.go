@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Log records hold the ciphertext that was stored in the tree, sealed for the
+// index key it was stored under, so replay writes them back as they are
+// instead of repeating the operations. Every operation is applied as the
+// state it leaves behind: a put, including the EXPIRE records of Expire and
+// Persist, stores the logged entry whether or not the key is already there,
+// and a delete of a missing key does nothing. Replaying a record again
+// therefore leaves the tree unchanged, and a tree reopened after a crash
+// during replay ends up in the same state as one that replayed the log once.
+
+// putEntry returns the log entry of a put of key that stored kv.
+func putEntry(operation, key string, kv *KeyValue) LogEntry {
+	entry := LogEntry{Operation: operation, Key: key, Value: kv.Value, EncryptedKey: kv.EncryptedKey, ExpiresAt: kv.ExpiresAt}
+	if kv.Key != key {
+		entry.IndexKey = kv.Key
+	}
+	return entry
+}
+
+// replayEntry applies a log record to the tree under the tree lock.
+func (b *BTree) replayEntry(entry LogEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ops := []LogEntry{entry}
+	if entry.Operation == "BATCH" {
+		ops = entry.Ops
+	}
+	for _, op := range ops {
+		switch op.Operation {
+		case "CREATE", "UPDATE", "EXPIRE", "DELETE", "IMPORT":
+		default:
+			return fmt.Errorf("%w: unknown operation %q in LSN %d", ErrCorruptLogRecord, op.Operation, entry.LSN)
+		}
+	}
+
+	for _, op := range ops {
+		var err error
+		switch op.Operation {
+		case "DELETE":
+			err = b.replayDelete(op)
+		case "IMPORT":
+			err = b.replayImport(op, entry.LSN)
+		default:
+			err = b.replayPut(op, entry.LSN)
+		}
+		if err != nil {
+			return b.abort(fmt.Errorf("failed to replay %s of LSN %d: %w", op.Operation, entry.LSN, err))
+		}
+	}
+	b.modCount++
+	return nil
+}
+
+// replayPut stores the value of a logged put under the index key it was
+// sealed for, replacing the entry of the key under any other index key. The
+// entry gets the LSN of the record as its version. Records that do not carry
+// the index key stored the key under itself, in KeyModePlain.
+func (b *BTree) replayPut(op LogEntry, lsn uint64) error {
+	kv := &KeyValue{Key: op.IndexKey, Value: op.Value, EncryptedKey: op.EncryptedKey, ExpiresAt: op.ExpiresAt, Version: lsn}
+	if kv.Key == "" {
+		kv.Key = b.indexKey(op.Key)
+	}
+	if err := b.removeOtherForms(op.Key, kv.Key); err != nil {
+		return err
+	}
+
+	found, err := b.modifyKey(b.root, kv.Key, func(stored *KeyValue) error {
+		stored.Value = kv.Value
+		stored.ExpiresAt = kv.ExpiresAt
+		stored.Version = kv.Version
+		stored.EncryptedKey = kv.EncryptedKey
+		return nil
+	})
+	if err != nil || found {
+		return err
+	}
+	return b.insertKV(kv)
+}
+
+// replayImport stores a value imported from a v1.2.4 log, see
+// importGobDatabase. It was sealed under the shared nonce of the key set, and
+// is sealed again in the current format before it is stored like any put. The
+// checkpoint that ends replay drops the IMPORT records from the log, so the
+// shared nonce is not needed again.
+func (b *BTree) replayImport(op LogEntry, lsn uint64) error {
+	if len(b.legacyNonce) != chacha20poly1305.NonceSizeX {
+		return fmt.Errorf("values imported from v1.2.4 need their shared nonce of %d bytes as KeySet.Nonce", chacha20poly1305.NonceSizeX)
+	}
+	plain, err := b.decryptLegacy(op.Value, b.valueKeys().current)
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+	kv, err := b.newKeyValue(op.Key, plain)
+	if err != nil {
+		return err
+	}
+	return b.replayPut(putEntry("CREATE", op.Key, kv), lsn)
+}
+
+// replayDelete removes a logged key under every index key it may be stored
+// under, including the one recorded with the delete, if any.
+func (b *BTree) replayDelete(op LogEntry) error {
+	if op.IndexKey != "" {
+		if _, err := b.removeKey(op.IndexKey); err != nil {
+			return err
+		}
+	}
+	return b.removeOtherForms(op.Key, op.IndexKey)
+}
+
+// removeOtherForms removes the entries of key under its current index key and
+// under the HMAC key being rotated out, except the one under indexKey.
+func (b *BTree) removeOtherForms(key, indexKey string) error {
+	forms := []string{b.indexKey(key)}
+	if old, ok := b.previousIndexKey(key); ok {
+		forms = append(forms, old)
+	}
+	for _, form := range forms {
+		if form == indexKey {
+			continue
+		}
+		if _, err := b.removeKey(form); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readLog returns the records of the log file in dir.
+func readLog(t *testing.T, dir string) []LogEntry {
+	t.Helper()
+	file, err := os.Open(filepath.Join(dir, "kayvee.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if _, err := readLogHeader(reader); err != nil {
+		t.Fatal(err)
+	}
+	var entries []LogEntry
+	for {
+		entry, _, err := readLogRecord(reader)
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// TestReplayTwice checks that every operation type survives a crash, that
+// replaying the same records again leaves the tree unchanged, and that
+// restarting from the same files twice gives the same state.
+func TestReplayTwice(t *testing.T) {
+	const keys = 40
+	for _, keyMode := range []KeyMode{KeyModeHMAC, KeyModePlain} {
+		t.Run(keyMode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			b := openTestTree(t, dir, 10, keyMode)
+			model := make(map[string][]byte)
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("key-%04d", i)
+				model[key] = []byte(fmt.Sprint("created ", i))
+				if err := b.Insert(key, model[key]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Part of the operations are already in the tree when the log is replayed
+			if err := b.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("key-%04d", i)
+				var err error
+				switch i % 5 {
+				case 0:
+					model[key] = []byte(fmt.Sprint("updated ", i))
+					err = b.Update(key, model[key])
+				case 1:
+					delete(model, key)
+					err = b.Delete(key)
+				case 2:
+					err = b.Expire(key, time.Hour)
+				case 3:
+					// Deleted and created again, so replay must not apply the delete last
+					model[key] = []byte(fmt.Sprint("recreated ", i))
+					if err = b.Delete(key); err == nil {
+						err = b.Insert(key, model[key])
+					}
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			crash := copyDatabase(t, dir)
+			replayed := copyDatabase(t, crash)
+			first := openTestTree(t, replayed, 10, keyMode)
+			if first.Recovery().Replayed == 0 {
+				t.Fatal("nothing was replayed")
+			}
+			checkModel(t, first, model, keys)
+			for i := 2; i < keys; i += 5 {
+				if ttl, err := first.TTL(fmt.Sprintf("key-%04d", i)); err != nil || ttl <= 0 {
+					t.Fatalf("expiry of key-%04d was lost: %v, %v", i, ttl, err)
+				}
+			}
+
+			// Applying every record again changes nothing
+			for _, entry := range readLog(t, crash) {
+				if err := first.replayEntry(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkModel(t, first, model, keys)
+
+			second := openTestTree(t, copyDatabase(t, crash), 10, keyMode)
+			checkModel(t, second, model, keys)
+			closeTestTree(t, second)
+
+			// Reopening the replayed tree replays nothing more
+			closeTestTree(t, first)
+			reopened := openTestTree(t, replayed, 10, keyMode)
+			if n := reopened.Recovery().Replayed; n != 0 {
+				t.Fatalf("%d records were replayed again", n)
+			}
+			checkModel(t, reopened, model, keys)
+			closeTestTree(t, reopened)
+			closeTestTree(t, b)
+		})
+	}
+}
@@ -0,0 +1,465 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Every encrypted value records the ID of the key it was sealed with, see
+// valueFormat. Rotating the encryption key keeps the old key readable, seals
+// every write with the new key, and re-encrypts existing values under it:
+// lazily when Read finds a value under the old key, and eagerly in a
+// background sweep over the whole tree. Once the sweep has covered every
+// value, a checkpoint commits the result and truncates the log, and the
+// rotation finishes: from then on the old key is no longer used.
+//
+// Starting and finishing a rotation both take a checkpoint, and the superblock
+// records the keys of the committed tree, see keyState. If the process stops
+// before the rotation finishes, open the tree with the new key as
+// KeySet.EncryptionKey and the old one as KeySet.PreviousEncryptionKey, and
+// the sweep resumes; any other key set is refused with ErrKeyMismatch.
+
+// rotationBatchSize is the number of keys the sweep visits per lock acquisition.
+const rotationBatchSize = 128
+
+// ErrWrongKey is returned when a value was sealed with an encryption key the
+// tree does not hold.
+var ErrWrongKey = errors.New("value is encrypted under a different key")
+
+// ErrKeyMismatch is returned when a database is opened with other keys than
+// the ones its committed tree is sealed and indexed with, or without the old
+// key of a rotation that has not finished.
+var ErrKeyMismatch = errors.New("keys do not match the database")
+
+// ErrRotationInProgress is returned when a rotation is started while another
+// one of the same kind has not finished.
+var ErrRotationInProgress = errors.New("another key rotation is in progress")
+
+// RotationProgress reports the state of the last key rotation.
+type RotationProgress struct {
+	Active      bool      // Set from RotateEncryptionKey until the rotation finishes
+	OldKeyID    uint32    // ID of the key being rotated out
+	NewKeyID    uint32    // ID of the key values are re-encrypted under
+	Started     time.Time // When the rotation was started or resumed
+	Finished    time.Time // When the rotation finished, zero while it is active
+	Total       int       // Keys in the tree when the sweep started
+	Scanned     int       // Keys visited by the sweep
+	Reencrypted int       // Values re-encrypted by the sweep or by Read
+	Err         error     // Why the sweep stopped before finishing, nil if it did not
+}
+
+// keyRotation is a rotation from one encryption key to another. Key names are
+// sealed with keys derived from the value keys, see keyNameKey, and are
+// rotated along with the values.
+type keyRotation struct {
+	oldKey, newKey   []byte
+	newID, newNameID uint32
+	done             atomic.Bool   // Set when the rotation has finished
+	stop             chan struct{} // Identifies the running sweep, which stops once it is replaced; nil if none
+
+	// Guarded by BTree.mu
+	progress RotationProgress
+}
+
+// keyRing holds the keys of one kind, for values or for key names, that
+// stored data may be sealed with.
+type keyRing struct {
+	current  []byte // Key new data is sealed with
+	previous []byte // Key being rotated out, nil if none
+}
+
+// open returns the key with the given ID.
+func (k keyRing) open(id uint32) ([]byte, error) {
+	if keyID(k.current) == id {
+		return k.current, nil
+	}
+	if k.previous != nil && keyID(k.previous) == id {
+		return k.previous, nil
+	}
+	return nil, ErrWrongKey
+}
+
+// keyID returns the ID recorded with values sealed with key. It is derived
+// from the key, so opening a database never needs a stored key list.
+func keyID(key []byte) uint32 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kayveedb key id"))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+// keyState identifies the keys a committed tree is sealed and indexed with by
+// their key IDs, see keyID, and is recorded in the superblock. The previous
+// keys are set while a rotation of their kind is running and zero otherwise,
+// as are the HMAC keys in KeyModePlain.
+type keyState struct {
+	encryption, previousEncryption uint32
+	hmac, previousHMAC             uint32
+}
+
+// keyState returns the key state of the tree.
+// It is safe to call without the tree lock.
+func (b *BTree) keyState() keyState {
+	var keys keyState
+	values := b.valueKeys()
+	keys.encryption = keyID(values.current)
+	if values.previous != nil {
+		keys.previousEncryption = keyID(values.previous)
+	}
+	if b.keyMode != KeyModePlain {
+		keys.hmac = keyID(b.currentHMACKey())
+		if old, ok := b.previousHMACKey(); ok {
+			keys.previousHMAC = keyID(old)
+		}
+	}
+	return keys
+}
+
+// checkKeys returns an error wrapping ErrKeyMismatch unless the tree was opened
+// with the keys of the recorded key state.
+func (b *BTree) checkKeys(recorded keyState) error {
+	keys := b.keyState()
+	switch {
+	case keys.encryption != recorded.encryption:
+		return fmt.Errorf("%w: database is sealed with encryption key %08x, not %08x", ErrKeyMismatch, recorded.encryption, keys.encryption)
+	case keys.previousEncryption != recorded.previousEncryption && recorded.previousEncryption == 0:
+		return fmt.Errorf("%w: no encryption key rotation is in progress, open without PreviousEncryptionKey", ErrKeyMismatch)
+	case keys.previousEncryption != recorded.previousEncryption:
+		return fmt.Errorf("%w: rotation from encryption key %08x is in progress and needs it as PreviousEncryptionKey", ErrKeyMismatch, recorded.previousEncryption)
+	case keys.hmac != recorded.hmac:
+		return fmt.Errorf("%w: database is indexed with HMAC key %08x, not %08x", ErrKeyMismatch, recorded.hmac, keys.hmac)
+	case keys.previousHMAC != recorded.previousHMAC && recorded.previousHMAC == 0:
+		return fmt.Errorf("%w: no HMAC key rotation is in progress, open without PreviousHMACKey", ErrKeyMismatch)
+	case keys.previousHMAC != recorded.previousHMAC:
+		return fmt.Errorf("%w: rotation from HMAC key %08x is in progress and needs it as PreviousHMACKey", ErrKeyMismatch, recorded.previousHMAC)
+	}
+	return nil
+}
+
+// newKeyRotation returns a rotation from oldKey to newKey.
+func (b *BTree) newKeyRotation(oldKey, newKey []byte) *keyRotation {
+	r := &keyRotation{
+		oldKey:    oldKey,
+		newKey:    newKey,
+		newID:     keyID(newKey),
+		newNameID: keyID(b.keyNameKey(newKey)),
+	}
+	r.progress = RotationProgress{Active: true, OldKeyID: keyID(oldKey), NewKeyID: r.newID}
+	return r
+}
+
+// RotateEncryptionKey starts re-encrypting every value and key name under
+// newKey and returns once the background sweep is running. From then on,
+// every write is sealed with newKey, and values still under the old key stay
+// readable until the rotation finishes. Use RotationProgress to follow the
+// sweep. Calling it again with the same key resumes a rotation whose sweep
+// stopped.
+func (b *BTree) RotateEncryptionKey(newKey []byte) error {
+	if len(newKey) != chacha20poly1305.KeySize {
+		return fmt.Errorf("encryption key must be %d bytes", chacha20poly1305.KeySize)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil {
+		return b.failed
+	}
+
+	r := b.activeRotation()
+	if r != nil {
+		if r.newID != keyID(newKey) {
+			return ErrRotationInProgress
+		}
+		if r.stop != nil {
+			return nil
+		}
+	} else {
+		current := b.valueKeys().current
+		if keyID(current) == keyID(newKey) {
+			return errors.New("new encryption key is the same as the current one")
+		}
+		last := b.rotation.Load()
+		r = b.newKeyRotation(current, bytes.Clone(newKey))
+		b.rotation.Store(r)
+		// Record the rotation before anything is sealed with the new key
+		if err := b.checkpoint(); err != nil {
+			b.rotation.Store(last)
+			return err
+		}
+	}
+	b.startRotation(r)
+	return nil
+}
+
+// startRotation starts the sweep of a key rotation.
+func (b *BTree) startRotation(r *keyRotation) {
+	r.progress.Started = time.Now()
+	r.progress.Err = nil
+	r.stop = make(chan struct{})
+	go b.rotationSweep(r, r.stop)
+}
+
+// RotationProgress returns the progress of the current or last key rotation.
+// It returns false if no rotation was started since the tree was opened.
+func (b *BTree) RotationProgress() (RotationProgress, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r := b.rotation.Load()
+	if r == nil {
+		return RotationProgress{}, false
+	}
+	return r.progress, true
+}
+
+// activeRotation returns the rotation in progress, or nil if there is none.
+// It is safe to call without the tree lock.
+func (b *BTree) activeRotation() *keyRotation {
+	r := b.rotation.Load()
+	if r == nil || r.done.Load() {
+		return nil
+	}
+	return r
+}
+
+// valueKeys returns the keys values may be sealed with.
+// It is safe to call without the tree lock.
+func (b *BTree) valueKeys() keyRing {
+	r := b.rotation.Load()
+	switch {
+	case r == nil:
+		return keyRing{current: b.encryptionKey}
+	case r.done.Load():
+		return keyRing{current: r.newKey}
+	default:
+		return keyRing{current: r.newKey, previous: r.oldKey}
+	}
+}
+
+// nameKeys returns the keys key names may be sealed with.
+func (b *BTree) nameKeys() keyRing {
+	keys := b.valueKeys()
+	names := keyRing{current: b.keyNameKey(keys.current)}
+	if keys.previous != nil {
+		names.previous = b.keyNameKey(keys.previous)
+	}
+	return names
+}
+
+// treeSweep is a background sweep over every entry of the tree, as run by key
+// rotation and re-indexing. Its functions are called with the tree lock held.
+type treeSweep struct {
+	name    string                                    // Named in the message printed when the sweep stops on an error
+	running func() bool                               // Reports false once the sweep was replaced or stopped by Close
+	start   func(total int)                           // Called with the number of entries before the first batch
+	visit   func(item KeyValue) (func() error, error) // Returns the change to make to an entry, nil if none
+	settle  func(keys *keyState)                      // Clears the key the sweep rotates out from the key state it commits
+	finish  func()                                    // Called once the result of the sweep is committed
+	fail    func(err error)                           // Called when the sweep stops on an error
+}
+
+// runSweep runs a sweep in batches of rotationBatchSize entries until every
+// entry has been visited or it is stopped. Once it has covered the whole
+// tree, a checkpoint commits the result without the key rotated out, and
+// drops the log records written before the sweep; then the sweep finishes.
+func (b *BTree) runSweep(s treeSweep) {
+	total := 0
+	it := b.Range("", "", 0, false)
+	for it.Next() {
+		total++
+	}
+	err := it.Err()
+
+	b.mu.Lock()
+	if !s.running() {
+		b.mu.Unlock()
+		return
+	}
+	s.start(total)
+	b.mu.Unlock()
+
+	after := ""
+	for err == nil {
+		var done bool
+		b.mu.Lock()
+		if !s.running() {
+			// Stopped by Close while waiting for the lock
+			b.mu.Unlock()
+			return
+		}
+		if b.failed != nil {
+			err = b.failed
+		} else {
+			after, done, err = b.sweepBatch(s, after)
+			if err == nil && done {
+				keys := b.keyState()
+				s.settle(&keys)
+				if err = b.checkpointKeys(keys); err == nil {
+					s.finish()
+					b.mu.Unlock()
+					return
+				}
+			}
+		}
+		b.mu.Unlock()
+	}
+
+	fmt.Printf("%s stopped: %v\n", s.name, err)
+	b.mu.Lock()
+	s.fail(err)
+	b.mu.Unlock()
+}
+
+// sweepBatch visits up to rotationBatchSize entries following the index key
+// after, or from the first entry if after is empty, and makes the changes
+// the sweep returns for them. It returns the last key visited and whether the
+// end of the tree was reached.
+func (b *BTree) sweepBatch(s treeSweep, after string) (string, bool, error) {
+	c := b.NewCursor()
+	ok := c.seek(after)
+	if ok && after != "" && c.item.Key == after {
+		ok = c.next()
+	}
+
+	// Visit everything first, so the tree is only touched once nothing but
+	// an I/O error can fail
+	var changes []func() error
+	for n := 0; ok && n < rotationBatchSize; n++ {
+		after = c.item.Key
+		change, err := s.visit(c.item)
+		if err != nil {
+			return after, false, err
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+		ok = c.next()
+	}
+	if err := c.Err(); err != nil {
+		return after, false, err
+	}
+
+	for _, change := range changes {
+		if err := change(); err != nil {
+			return after, false, err
+		}
+	}
+	return after, !ok, nil
+}
+
+// rotationSweep re-encrypts every value and key name still sealed with the
+// old key of the rotation, then finishes it.
+func (b *BTree) rotationSweep(r *keyRotation, stop chan struct{}) {
+	b.runSweep(treeSweep{
+		name:    "Key rotation",
+		running: func() bool { return r.stop == stop },
+		start: func(total int) {
+			r.progress.Total = total
+			r.progress.Scanned = 0
+		},
+		visit: func(item KeyValue) (func() error, error) {
+			r.progress.Scanned++
+			if !r.stale(item) {
+				return nil, nil
+			}
+			kv, err := b.reencrypt(r, item)
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return b.storeReencrypted(kv) }, nil
+		},
+		settle: func(keys *keyState) { keys.previousEncryption = 0 },
+		finish: func() {
+			r.progress.Active = false
+			r.progress.Finished = time.Now()
+			r.stop = nil
+			r.done.Store(true)
+		},
+		fail: func(err error) {
+			r.progress.Err = err
+			if r.stop == stop {
+				r.stop = nil
+			}
+		},
+	})
+}
+
+// reencryptStale re-encrypts the value stored under an index key after Read
+// found it sealed with the old key of the rotation. It is a best effort: the
+// sweep covers anything it skips.
+func (b *BTree) reencryptStale(r *keyRotation, key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed != nil || b.activeRotation() != r {
+		return
+	}
+	item := b.search(b.root, key)
+	if item == nil || !r.stale(*item) {
+		return
+	}
+	kv, err := b.reencrypt(r, *item)
+	if err != nil {
+		return
+	}
+	b.storeReencrypted(kv)
+}
+
+// storeReencrypted replaces the value and key name stored under kv.Key with
+// their re-encrypted forms.
+func (b *BTree) storeReencrypted(kv KeyValue) error {
+	_, err := b.modifyKey(b.root, kv.Key, func(stored *KeyValue) error {
+		stored.Value = kv.Value
+		stored.EncryptedKey = kv.EncryptedKey
+		return nil
+	})
+	if err != nil {
+		return b.abort(err)
+	}
+	b.modCount++
+	return nil
+}
+
+// stale reports whether the value or key name of kv is not yet sealed with the new key.
+func (r *keyRotation) stale(kv KeyValue) bool {
+	if valueKeyID(kv.Value) != r.newID {
+		return true
+	}
+	return kv.EncryptedKey != nil && valueKeyID(kv.EncryptedKey) != r.newNameID
+}
+
+// reencrypt returns kv with its value and key name sealed with the new keys
+// of the rotation. Re-encrypted values are not logged: the sweep finishes with
+// a checkpoint, and until then a value whose re-encryption is lost is still
+// readable with the old key.
+func (b *BTree) reencrypt(r *keyRotation, kv KeyValue) (KeyValue, error) {
+	if valueKeyID(kv.Value) != r.newID {
+		plain, err := b.decrypt(kv.Value, b.valueKeys(), kv.Key)
+		if err != nil {
+			return kv, fmt.Errorf("failed to decrypt value for re-encryption: %w", err)
+		}
+		if kv.Value, err = b.encrypt(plain, b.valueKeys(), kv.Key); err != nil {
+			return kv, err
+		}
+		r.progress.Reencrypted++
+	}
+
+	if kv.EncryptedKey != nil && valueKeyID(kv.EncryptedKey) != r.newNameID {
+		name, err := b.decrypt(kv.EncryptedKey, b.nameKeys(), kv.Key)
+		if err != nil {
+			return kv, fmt.Errorf("failed to decrypt key name for re-encryption: %w", err)
+		}
+		if kv.EncryptedKey, err = b.encrypt(name, b.nameKeys(), kv.Key); err != nil {
+			return kv, err
+		}
+	}
+	return kv, nil
+}
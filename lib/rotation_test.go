@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rotationKinds are the two kinds of key rotation, with the key set a tree is
+// opened with after its rotation from the test keys to newKey.
+var rotationKinds = map[string]struct {
+	rotate func(b *BTree, newKey []byte) error
+	active func(b *BTree) (bool, error)
+	keys   func(newKey []byte, previous bool) *KeySet
+}{
+	"encryption": {
+		rotate: (*BTree).RotateEncryptionKey,
+		active: func(b *BTree) (bool, error) {
+			p, _ := b.RotationProgress()
+			return p.Active, p.Err
+		},
+		keys: func(newKey []byte, previous bool) *KeySet {
+			keys := &KeySet{HMACKey: testHMACKey, EncryptionKey: newKey}
+			if previous {
+				keys.PreviousEncryptionKey = testEncryptionKey
+			}
+			return keys
+		},
+	},
+	"hmac": {
+		rotate: (*BTree).RotateHMACKey,
+		active: func(b *BTree) (bool, error) {
+			p, _ := b.ReindexProgress()
+			return p.Active, p.Err
+		},
+		keys: func(newKey []byte, previous bool) *KeySet {
+			keys := &KeySet{HMACKey: newKey, EncryptionKey: testEncryptionKey}
+			if previous {
+				keys.PreviousHMACKey = testHMACKey
+			}
+			return keys
+		},
+	},
+}
+
+// rotate rotates the keys of a tree holding a few keys and waits for the
+// sweep to stop. With broken set, one of the values cannot be decrypted, so
+// the sweep stops on it and the rotation stays in progress.
+func rotate(t *testing.T, b *BTree, kind string, newKey []byte, broken bool) {
+	t.Helper()
+	for _, key := range []string{"alpha", "beta", "gamma"} {
+		if err := b.Insert(key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if broken {
+		b.mu.Lock()
+		_, err := b.modifyKey(b.root, b.indexKey("beta"), func(kv *KeyValue) error {
+			kv.Value = bytes.Clone(kv.Value)
+			kv.Value[len(kv.Value)-1] ^= 0xff
+			return nil
+		})
+		b.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rotationKinds[kind].rotate(b, newKey); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		active, err := rotationKinds[kind].active(b)
+		if !active || err != nil {
+			if active != broken || (err != nil) != broken {
+				t.Fatalf("rotation stopped with active %v, error %v", active, err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rotation did not stop")
+		}
+	}
+}
+
+// openKeys opens the tree in dir with a copy of keys.
+func openKeys(dir string, keys *KeySet) (*BTree, error) {
+	return NewBTreeWithOptions(3, dir, "", "", keySetProvider{keys.clone()}, 10, Options{ExpiryInterval: -1, Durability: DurabilityNone})
+}
+
+// TestRotationState checks that a database records whether a rotation is in
+// progress and is only opened with the keys it needs.
+func TestRotationState(t *testing.T) {
+	newKey := bytes.Repeat([]byte{0x33}, 32)
+	for kind, k := range rotationKinds {
+		t.Run(kind, func(t *testing.T) {
+			// The process stops during the rotation
+			b := openTestTree(t, t.TempDir(), 10, KeyModeHMAC)
+			rotate(t, b, kind, newKey, true)
+			dir := copyDatabase(t, b.dbPath)
+			closeTestTree(t, b)
+
+			refused := map[string]*KeySet{
+				"old keys":             {HMACKey: testHMACKey, EncryptionKey: testEncryptionKey},
+				"new keys without old": k.keys(newKey, false),
+				"wrong encryption key": {HMACKey: testHMACKey, EncryptionKey: bytes.Repeat([]byte{0x44}, 32)},
+				"wrong HMAC key":       {HMACKey: bytes.Repeat([]byte{0x44}, 32), EncryptionKey: testEncryptionKey},
+			}
+			for name, keys := range refused {
+				if _, err := openKeys(dir, keys); !errors.Is(err, ErrKeyMismatch) {
+					t.Fatalf("opened with %s: expected ErrKeyMismatch, got %v", name, err)
+				}
+			}
+			b, err := openKeys(dir, k.keys(newKey, true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value, err := b.Read("alpha"); err != nil || string(value) != "value of alpha" {
+				t.Fatalf("read alpha: %q, %v", value, err)
+			}
+			closeTestTree(t, b)
+
+			// The rotation finishes
+			dir = t.TempDir()
+			b = openTestTree(t, dir, 10, KeyModeHMAC)
+			rotate(t, b, kind, newKey, false)
+			closeTestTree(t, b)
+
+			if _, err := openKeys(dir, k.keys(newKey, true)); !errors.Is(err, ErrKeyMismatch) {
+				t.Fatalf("opened with the keys of a finished rotation: expected ErrKeyMismatch, got %v", err)
+			}
+			b, err = openKeys(dir, k.keys(newKey, false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value, err := b.Read("gamma"); err != nil || string(value) != "value of gamma" {
+				t.Fatalf("read gamma: %q, %v", value, err)
+			}
+			closeTestTree(t, b)
+		})
+	}
+}
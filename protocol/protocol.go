@@ -3,6 +3,7 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -31,14 +32,24 @@ const (
 	CommandConnect     CommandType = 0x0F
 	CommandDisconnect  CommandType = 0x10
 	// New Command Types for Advanced Features
-	CommandListPush    CommandType = 0x11
-	CommandListRange   CommandType = 0x12
-	CommandSetAdd      CommandType = 0x13
-	CommandSetMembers  CommandType = 0x14
-	CommandHashSet     CommandType = 0x15
-	CommandHashGet     CommandType = 0x16
-	CommandZSetAdd     CommandType = 0x17
-	CommandZSetRange   CommandType = 0x18
+	CommandListPush   CommandType = 0x11
+	CommandListRange  CommandType = 0x12
+	CommandSetAdd     CommandType = 0x13
+	CommandSetMembers CommandType = 0x14
+	CommandHashSet    CommandType = 0x15
+	CommandHashGet    CommandType = 0x16
+	CommandZSetAdd    CommandType = 0x17
+	CommandZSetRange  CommandType = 0x18
+	// Admin Command Types
+	CommandCompact CommandType = 0x19
+	// Conditional write Command Types
+	CommandCompareAndSwap CommandType = 0x1A
+	CommandInsertIfAbsent CommandType = 0x1B
+	// Counter Command Types
+	CommandIncr        CommandType = 0x1C
+	CommandIncrBy      CommandType = 0x1D
+	CommandDecrBy      CommandType = 0x1E
+	CommandIncrByFloat CommandType = 0x1F
 )
 
 type StatusCode uint32
@@ -56,6 +67,7 @@ const (
 	StatusTxRollback    StatusCode = 0x04
 	StatusClientAdded   StatusCode = 0x05
 	StatusClientRemoved StatusCode = 0x06
+	StatusConflict      StatusCode = 0x07
 )
 
 // Packet represents a protocol packet.
@@ -80,9 +92,9 @@ var (
 )
 
 // Initialize BTree
-func InitBTree(t int, dbPath, dbName, logName string, hmacKey, encryptionKey, nonce []byte, cacheSize int) error {
+func InitBTree(t int, dbPath, dbName, logName string, keys lib.KeyProvider, cacheSize int) error {
 	var err error
-	bTreeInstance, err = lib.NewBTree(t, dbPath, dbName, logName, hmacKey, encryptionKey, nonce, cacheSize)
+	bTreeInstance, err = lib.NewBTree(t, dbPath, dbName, logName, keys, cacheSize)
 	if err != nil {
 		return fmt.Errorf("InitBTree failed: %w", err)
 	}
@@ -105,6 +117,75 @@ func HandleClientDisconnect(clientID uint32) error {
 	return bTreeInstance.RemoveClient(clientID)
 }
 
+// HandleCompact compacts the database file of the BTree and reports the bytes reclaimed.
+func HandleCompact() (lib.CompactionResult, error) {
+	if bTreeInstance == nil {
+		return lib.CompactionResult{}, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.Compact()
+}
+
+// HandleCompareAndSwap replaces the value of a key if it is at expectedVersion
+// and returns its new version.
+func HandleCompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	if bTreeInstance == nil {
+		return 0, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.CompareAndSwap(key, expectedVersion, value)
+}
+
+// HandleInsertIfAbsent inserts a key-value pair if the key is not present and
+// returns its version.
+func HandleInsertIfAbsent(key string, value []byte) (uint64, error) {
+	if bTreeInstance == nil {
+		return 0, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.InsertIfAbsent(key, value)
+}
+
+// HandleIncr adds one to the integer value of a key and returns the new value.
+func HandleIncr(key string) (int64, error) {
+	if bTreeInstance == nil {
+		return 0, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.Incr(key)
+}
+
+// HandleIncrBy adds delta to the integer value of a key and returns the new value.
+func HandleIncrBy(key string, delta int64) (int64, error) {
+	if bTreeInstance == nil {
+		return 0, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.IncrBy(key, delta)
+}
+
+// HandleDecrBy subtracts delta from the integer value of a key and returns the new value.
+func HandleDecrBy(key string, delta int64) (int64, error) {
+	if bTreeInstance == nil {
+		return 0, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.DecrBy(key, delta)
+}
+
+// HandleIncrByFloat adds delta to the numeric value of a key and returns the new value.
+func HandleIncrByFloat(key string, delta float64) (float64, error) {
+	if bTreeInstance == nil {
+		return 0, fmt.Errorf("BTree instance not initialized")
+	}
+	return bTreeInstance.IncrByFloat(key, delta)
+}
+
+// StatusForError returns the status code to answer a failed command with:
+// StatusConflict for a conditional write that was not applied, StatusError
+// otherwise.
+func StatusForError(err error) StatusCode {
+	var conflict *lib.ConflictError
+	if errors.As(err, &conflict) {
+		return StatusConflict
+	}
+	return StatusError
+}
+
 // SetMaxPayloadSize sets a new maximum payload size.
 func SetMaxPayloadSize(size uint32) {
 	mu.Lock()
@@ -235,6 +316,20 @@ func (c CommandType) String() string {
 		return "ZSet Add"
 	case CommandZSetRange:
 		return "ZSet Range"
+	case CommandCompact:
+		return "Compact"
+	case CommandCompareAndSwap:
+		return "Compare And Swap"
+	case CommandInsertIfAbsent:
+		return "Insert If Absent"
+	case CommandIncr:
+		return "Incr"
+	case CommandIncrBy:
+		return "Incr By"
+	case CommandDecrBy:
+		return "Decr By"
+	case CommandIncrByFloat:
+		return "Incr By Float"
 	default:
 		return "Unknown"
 	}
@@ -257,6 +352,8 @@ func (s StatusCode) String() string {
 		return "Client Added"
 	case StatusClientRemoved:
 		return "Client Removed"
+	case StatusConflict:
+		return "Conflict"
 	default:
 		return "Unknown"
 	}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rickcollette/kayveedb/lib"
+)
+
+// TestConditionalWriteHandlers checks that the conditional write handlers
+// answer conflicts with StatusConflict.
+func TestConditionalWriteHandlers(t *testing.T) {
+	keys := lib.StaticKeys(bytes.Repeat([]byte{0x11}, 32), bytes.Repeat([]byte{0x22}, 32), nil)
+	if err := InitBTree(3, t.TempDir(), "", "", keys, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := bTreeInstance.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		bTreeInstance = nil
+	}()
+
+	version, err := HandleInsertIfAbsent("key", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = HandleInsertIfAbsent("key", []byte("second"))
+	if !errors.Is(err, lib.ErrKeyExists) || StatusForError(err) != StatusConflict {
+		t.Fatalf("second insert returned %v with status %v", err, StatusForError(err))
+	}
+
+	_, err = HandleCompareAndSwap("key", version+1, []byte("stale"))
+	if !errors.Is(err, lib.ErrVersionConflict) || StatusForError(err) != StatusConflict {
+		t.Fatalf("swap at a stale version returned %v with status %v", err, StatusForError(err))
+	}
+	swapped, err := HandleCompareAndSwap("key", version, []byte("swapped"))
+	if err != nil || swapped <= version {
+		t.Fatalf("swap returned version %d, %v after version %d", swapped, err, version)
+	}
+
+	if status := StatusForError(errors.New("failed")); status != StatusError {
+		t.Fatalf("other errors are answered with %v", status)
+	}
+}